@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -13,29 +15,240 @@ import (
 type Admin struct {
 	server   http.Server
 	proxyMgr *ProxyMgr
+	reloader *Reloader
+	// the readiness reported by the /ready endpoint, it is failing after shutdown starts
+	ready int32
+	// save the changes made through the admin API if it is not nil
+	persister *Persister
+}
+
+type ProxyConfs struct {
+	Proxies []ProxyConf
 }
 
 type ProxyBackends struct {
 	Proxies []struct {
 		Name     string
+		Route    string `yaml:"route,omitempty"`
 		Backends []BackendInfo
 	}
 }
 
-func NewAdmin(addr string, proxyMgr *ProxyMgr) *Admin {
-	admin := &Admin{proxyMgr: proxyMgr}
+func NewAdmin(addr string, proxyMgr *ProxyMgr, reloader *Reloader) *Admin {
+	admin := &Admin{proxyMgr: proxyMgr, reloader: reloader, ready: 1}
 	admin.server.Addr = addr
 	router := mux.NewRouter()
 	router.HandleFunc("/backends/add", admin.processAddBackend)
 	router.HandleFunc("/backends/remove", admin.processRemoveBackend)
+	router.HandleFunc("/backends/drain", admin.processDrainBackend)
 	router.HandleFunc("/backends/list", admin.processGetBackends)
+	router.HandleFunc("/proxies/add", admin.processAddProxy)
+	router.HandleFunc("/proxies/update", admin.processUpdateProxy)
+	router.HandleFunc("/proxies/remove", admin.processRemoveProxy)
+	router.HandleFunc("/proxies/list", admin.processGetProxies)
 	router.HandleFunc("/loglevel", admin.processLogLevel)
+	router.HandleFunc("/ready", admin.processReady)
+	router.HandleFunc("/config/reload", admin.processReload)
+	router.HandleFunc("/config", admin.processGetConfig)
 	admin.server.Handler = router
 	return admin
 }
 
 func (admin *Admin) Start() {
-	go admin.server.ListenAndServe()
+	ln, err := listen(getHTTPListenAddr(admin.server.Addr))
+	if err != nil {
+		log.WithFields(log.Fields{"address": admin.server.Addr, "error": err}).Error("Fail to listen on admin address")
+		return
+	}
+	go admin.server.Serve(ln)
+}
+
+// SetReady set the readiness reported by the /ready endpoint
+func (admin *Admin) SetReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&admin.ready, 1)
+	} else {
+		atomic.StoreInt32(&admin.ready, 0)
+	}
+}
+
+func (admin *Admin) processReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&admin.ready) != 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
+	}
+}
+
+// SetPersister set the persister to save the changes made through the admin API
+func (admin *Admin) SetPersister(persister *Persister) {
+	admin.persister = persister
+}
+
+// persist save the running configuration after the proxies are changed or removed
+func (admin *Admin) persist(proxies []string, removed bool) {
+	if admin.persister == nil || len(proxies) <= 0 {
+		return
+	}
+	err := admin.persister.Save(admin.reloader.GetRunningConfig, proxies, removed)
+	if err != nil {
+		log.WithFields(log.Fields{"proxies": proxies, "error": err}).Error("Fail to save the running configuration")
+	}
+}
+
+// processGetConfig dump the running configuration as yaml
+func (admin *Admin) processGetConfig(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := yaml.Marshal(admin.reloader.GetRunningConfig())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Fail to encode the configuration as yaml"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// processReload reload the configuration by POST and get the result of last reload by GET
+func (admin *Admin) processReload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var result *ReloadResult
+	switch r.Method {
+	case http.MethodGet:
+		result = admin.reloader.GetLastResult()
+		if result == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("The configuration is not reloaded"))
+			return
+		}
+	case http.MethodPost, http.MethodPut:
+		result = admin.reloader.Reload()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Fail to encode the reload result as json"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if result.Success {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(b)
+}
+
+func (admin *Admin) processAddProxy(w http.ResponseWriter, r *http.Request) {
+	admin.processProxy(w, r, false, func(proxyConf *ProxyConf) error {
+		err := admin.proxyMgr.CreateProxy(proxyConf)
+		if err == nil {
+			log.WithFields(log.Fields{"proxy": proxyConf.Name}).Info("Add proxy")
+		}
+		return err
+	})
+}
+
+func (admin *Admin) processUpdateProxy(w http.ResponseWriter, r *http.Request) {
+	admin.processProxy(w, r, false, func(proxyConf *ProxyConf) error {
+		changes, err := admin.proxyMgr.UpdateProxy(proxyConf, admin.reloader.GetShutdownTimeout())
+		for _, change := range changes {
+			log.Info(change)
+		}
+		return err
+	})
+}
+
+func (admin *Admin) processRemoveProxy(w http.ResponseWriter, r *http.Request) {
+	admin.processProxy(w, r, true, func(proxyConf *ProxyConf) error {
+		err := admin.proxyMgr.DeleteProxy(proxyConf.Name, admin.reloader.GetShutdownTimeout())
+		if err == nil {
+			log.WithFields(log.Fields{"proxy": proxyConf.Name}).Info("Remove proxy")
+		}
+		return err
+	})
+}
+
+// processProxy process the proxies in request body by procFunc, the
+// failed proxies are replied with status 400
+func (admin *Admin) processProxy(w http.ResponseWriter, r *http.Request, removed bool, procFunc func(proxyConf *ProxyConf) error) {
+	defer r.Body.Close()
+	proxyConfs := &ProxyConfs{}
+	content, err := io.ReadAll(r.Body)
+	if err == nil && removed {
+		err = yaml.Unmarshal(content, proxyConfs)
+	} else if err == nil {
+		// the added or updated proxies are checked like the configuration file
+		proxyConfs, err = validateProxies("request", content)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Fail to decode the proxies: %v\n", err)
+		return
+	}
+	failed := make([]string, 0)
+	succeeded := make([]string, 0)
+	for i := range proxyConfs.Proxies {
+		proxyConf := &proxyConfs.Proxies[i]
+		err = procFunc(proxyConf)
+		if err != nil {
+			log.WithFields(log.Fields{"proxy": proxyConf.Name, "error": err}).Error("fail to process the proxy")
+			failed = append(failed, fmt.Sprintf("%s: %v", proxyConf.Name, err))
+		} else {
+			succeeded = append(succeeded, proxyConf.Name)
+		}
+	}
+	admin.persist(succeeded, removed)
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		for _, s := range failed {
+			fmt.Fprintln(w, s)
+		}
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (admin *Admin) processGetProxies(w http.ResponseWriter, r *http.Request) {
+	result := make([]interface{}, 0)
+	for _, proxy := range admin.proxyMgr.GetAllProxy() {
+		proxyInfo := struct {
+			Name           string
+			Listen         string
+			RequestTimeout string
+			LoadBalancer   string `json:",omitempty"`
+			Routes         int
+			Clients        int
+		}{Name: proxy.GetName(),
+			Listen:         proxy.addr,
+			RequestTimeout: proxy.getRequestTimeout().String(),
+			Routes:         len(proxy.GetAllRoutes()) - 1,
+			Clients:        len(proxy.getClients())}
+		if conf := proxy.getConf(); conf != nil {
+			proxyInfo.LoadBalancer = conf.LoadBalancer
+		}
+		result = append(result, &proxyInfo)
+	}
+	b, err := json.Marshal(result)
+	if err == nil {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Fail to encode the proxies as json"))
+	}
 }
 
 func (admin *Admin) processAddBackend(w http.ResponseWriter, r *http.Request) {
@@ -60,6 +273,17 @@ func (admin *Admin) processRemoveBackend(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (admin *Admin) processDrainBackend(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	proxyBackends, err := admin.readProxyBackends(r)
+	if err == nil {
+		admin.drainBackend(proxyBackends)
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (admin *Admin) processGetBackends(w http.ResponseWriter, r *http.Request) {
 	result := admin.getAllBackends()
 	b, err := json.Marshal(result)
@@ -100,15 +324,48 @@ func (admin *Admin) getAllBackends() map[string][]interface{} {
 	result := make(map[string][]interface{})
 	for _, proxy := range allProxy {
 		backends := make([]interface{}, 0)
-		for _, backend := range proxy.GetAllBackends() {
-			addr := backend.GetAddr()
-			connected := backend.IsConnected()
-			backendInfo := struct {
-				Addr      string
-				Connected bool
-			}{addr, connected}
-			backends = append(backends, &backendInfo)
-
+		for _, route := range proxy.GetAllRoutes() {
+			for _, backend := range route.GetLoadBalancer().GetAllBackends() {
+				connections := backend.GetConnections()
+				slowStartFactor := backend.GetSlowStartFactor()
+				if slowStartFactor >= 1 {
+					slowStartFactor = 0
+				}
+				circuitState := ""
+				if cb, ok := backend.(*CircuitbreakBackend); ok {
+					circuitState = cb.GetCircuitState().String()
+				}
+				backendInfo := struct {
+					Addr           string
+					Connected      bool
+					Ready          bool
+					Healthy        bool
+					Draining       bool `json:",omitempty"`
+					Weight         int
+					SlowStart      float64 `json:",omitempty"`
+					Pending        int
+					Latency        string
+					PoolSize       int
+					Connections    []ConnectionStatus
+					CircuitBreaker string    `json:",omitempty"`
+					Ejection       *Ejection `json:",omitempty"`
+					Route          string    `json:",omitempty"`
+				}{Addr: backend.GetAddr(),
+					Connected:      backend.IsConnected(),
+					Ready:          backend.IsReady(),
+					Healthy:        backend.IsHealthy(),
+					Draining:       backend.IsDraining(),
+					Weight:         backend.GetWeight(),
+					SlowStart:      slowStartFactor,
+					Pending:        backend.GetPendingRequests(),
+					Latency:        backend.GetLatency().String(),
+					PoolSize:       len(connections),
+					Connections:    connections,
+					CircuitBreaker: circuitState,
+					Ejection:       route.GetLoadBalancer().GetEjection(backend),
+					Route:          route.GetName()}
+				backends = append(backends, &backendInfo)
+			}
 		}
 		result[proxy.GetName()] = backends
 	}
@@ -126,29 +383,43 @@ func (admin *Admin) readProxyBackends(r *http.Request) (*ProxyBackends, error) {
 	return proxyBackends, nil
 }
 
-func (admin *Admin) processBackend(proxyBackends *ProxyBackends, proxyProcFunc func(proxy *Proxy, backend *BackendInfo)) {
+// processBackend process the backends by proxyProcFunc, return the names of changed proxies
+func (admin *Admin) processBackend(proxyBackends *ProxyBackends, proxyProcFunc func(proxy *Proxy, route string, backend *BackendInfo) error) []string {
+	changed := make([]string, 0)
 	for _, proxyInfo := range proxyBackends.Proxies {
 		proxy, err := admin.proxyMgr.GetProxy(proxyInfo.Name)
 		if err == nil {
 			for _, backend := range proxyInfo.Backends {
-				proxyProcFunc(proxy, &backend)
+				err = proxyProcFunc(proxy, proxyInfo.Route, &backend)
+				if err != nil {
+					log.WithFields(log.Fields{"proxy": proxyInfo.Name, "route": proxyInfo.Route, "address": backend.Addr, "error": err}).Error("fail to process the backend")
+				}
 			}
+			changed = append(changed, proxyInfo.Name)
 		} else {
 			log.WithFields(log.Fields{"proxy": proxyInfo.Name}).Error("fail to find the proxy by name")
 		}
 	}
-
+	return changed
 }
 
 func (admin *Admin) addBackend(proxyBackends *ProxyBackends) {
-	admin.processBackend(proxyBackends, func(proxy *Proxy, backend *BackendInfo) {
-		proxy.AddBackend(backend)
+	changed := admin.processBackend(proxyBackends, func(proxy *Proxy, route string, backend *BackendInfo) error {
+		return proxy.AddBackend(route, backend)
 	})
+	admin.persist(changed, false)
 }
 
 func (admin *Admin) removeBackend(proxyBackends *ProxyBackends) {
-	admin.processBackend(proxyBackends, func(proxy *Proxy, backend *BackendInfo) {
-		proxy.RemoveBackend(backend.Addr)
+	changed := admin.processBackend(proxyBackends, func(proxy *Proxy, route string, backend *BackendInfo) error {
+		return proxy.RemoveBackend(route, backend.Addr)
+	})
+	admin.persist(changed, false)
+}
+
+func (admin *Admin) drainBackend(proxyBackends *ProxyBackends) {
+	admin.processBackend(proxyBackends, func(proxy *Proxy, route string, backend *BackendInfo) error {
+		return proxy.DrainBackend(route, backend.Addr)
 	})
 }
 
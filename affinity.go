@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Affinity the backends bound to a client connection, one backend
+// for each LoadBalancer
+type Affinity struct {
+	sync.Mutex
+	name     string
+	backends map[*backendPool]Backend
+}
+
+// NewAffinity create an Affinity for the client with name
+func NewAffinity(name string) *Affinity {
+	return &Affinity{name: name, backends: make(map[*backendPool]Backend)}
+}
+
+func (a *Affinity) GetName() string {
+	return a.name
+}
+
+func (a *Affinity) get(pool *backendPool) Backend {
+	a.Lock()
+	defer a.Unlock()
+	return a.backends[pool]
+}
+
+func (a *Affinity) bind(pool *backendPool, backend Backend) {
+	a.Lock()
+	defer a.Unlock()
+	a.backends[pool] = backend
+}
+
+// affinitySender send the requests of a client by router with affinity
+type affinitySender struct {
+	router   *Router
+	affinity *Affinity
+}
+
+func newAffinitySender(router *Router, affinity *Affinity) *affinitySender {
+	return &affinitySender{router: router, affinity: affinity}
+}
+
+func (a *affinitySender) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	a.router.SendWithAffinity(a.affinity, request, requestTimeoutTime, callback)
+}
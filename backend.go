@@ -3,7 +3,7 @@ package main
 import (
 	"errors"
 	log "github.com/sirupsen/logrus"
-	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -11,6 +11,8 @@ import (
 var notConnectedError error = errors.New("not connected")
 var requestTimeoutError error = errors.New("Request is timeout")
 var circuitBreakError error = errors.New("circuit break the backend")
+var backendDrainingError error = errors.New("backend is draining")
+var requestQueueFullError error = errors.New("the request queue of backend connection is full")
 
 type requestWithResponseCallback struct {
 	request            *Message
@@ -30,75 +32,161 @@ func newRequestWithResponseCallback(request *Message,
 type Backend interface {
 	Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback)
 	GetAddr() string
+	GetWeight() int
+	SetWeight(weight int)
+	// get the factor of weight in slow start, 1 if it is not in slow start
+	GetSlowStartFactor() float64
+	// get the number of requests sent but not responded
+	GetPendingRequests() int
+	// get the EWMA of the response latency
+	GetLatency() time.Duration
+	// get the status of the connections to backend
+	GetConnections() []ConnectionStatus
 	IsConnected() bool
+	// check if the backend passes the health check
+	IsHealthy() bool
+	// check if the backend passes the readiness probe
+	IsReady() bool
+	// stop sending new requests to the backend, the backend is stopped after
+	// the pending requests are responded or the drain timeout is reached
+	Drain()
+	IsDraining() bool
 	Stop()
 }
 
+// CircuitbreakBackend reject the requests to the backend if its circuit breaker is not closed
 type CircuitbreakBackend struct {
-	backend                Backend
-	successiveFailureTimes int32
-	failedTimes            int32
-	pauseDuration          time.Duration
-	resumeTime             time.Time
+	backend Backend
+	breaker *CircuitBreaker
 }
 
-func NewCircuitbreakBackend(backend Backend,
-	successiveFailureTimes int32,
-	pauseDuration time.Duration) *CircuitbreakBackend {
-
-	return &CircuitbreakBackend{backend: backend,
-		successiveFailureTimes: successiveFailureTimes,
-		failedTimes:            0,
-		pauseDuration:          pauseDuration,
-		resumeTime:             time.Now()}
+func NewCircuitbreakBackend(backend Backend, breaker *CircuitBreaker) *CircuitbreakBackend {
+	return &CircuitbreakBackend{backend: backend, breaker: breaker}
 }
 
 func (c *CircuitbreakBackend) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
-	if c.resumeTime.After(time.Now()) {
+	done, allowed := c.breaker.Allow()
+	if !allowed {
 		callback(nil, circuitBreakError)
 		return
 	}
 	c.backend.Send(request, requestTimeoutTime, func(response *Message, err error) {
-		if err == nil {
-			atomic.StoreInt32(&c.failedTimes, 0)
-			callback(response, err)
-		} else if atomic.AddInt32(&c.failedTimes, 1) >= c.successiveFailureTimes {
-			c.resumeTime = time.Now().Add(c.pauseDuration)
-			callback(nil, err)
-		} else {
-			callback(nil, err)
-		}
+		done(err != nil)
+		callback(response, err)
 	})
 }
 
+// GetCircuitState get the state of circuit breaker
+func (c *CircuitbreakBackend) GetCircuitState() CircuitState {
+	return c.breaker.GetState()
+}
+
 func (c *CircuitbreakBackend) GetAddr() string {
 	return c.backend.GetAddr()
 }
 
+func (c *CircuitbreakBackend) GetWeight() int {
+	return c.backend.GetWeight()
+}
+
+func (c *CircuitbreakBackend) SetWeight(weight int) {
+	c.backend.SetWeight(weight)
+}
+
+func (c *CircuitbreakBackend) GetSlowStartFactor() float64 {
+	return c.backend.GetSlowStartFactor()
+}
+
+func (c *CircuitbreakBackend) GetPendingRequests() int {
+	return c.backend.GetPendingRequests()
+}
+
+func (c *CircuitbreakBackend) GetLatency() time.Duration {
+	return c.backend.GetLatency()
+}
+
+func (c *CircuitbreakBackend) GetConnections() []ConnectionStatus {
+	return c.backend.GetConnections()
+}
+
 func (c *CircuitbreakBackend) IsConnected() bool {
 	return c.backend.IsConnected()
 }
 
+func (c *CircuitbreakBackend) IsHealthy() bool {
+	return c.backend.IsHealthy()
+}
+
+func (c *CircuitbreakBackend) IsReady() bool {
+	return c.backend.IsReady()
+}
+
+// Drain drain the wrapped backend, the circuit breaker is closed with
+// the backend after the backend is drained
+func (c *CircuitbreakBackend) Drain() {
+	if b, ok := c.backend.(*TcpBackend); ok {
+		b.drain(c.Stop)
+	} else {
+		c.backend.Drain()
+	}
+}
+
+func (c *CircuitbreakBackend) IsDraining() bool {
+	return c.backend.IsDraining()
+}
+
 func (c *CircuitbreakBackend) Stop() {
+	c.breaker.Close()
 	c.backend.Stop()
 }
 
+// the idle time after which the connections more than the minimum are closed
+const connIdleTimeout = time.Duration(60) * time.Second
+
+// the default time to wait for the pending requests when draining a backend
+const defaultDrainTimeout = time.Duration(30) * time.Second
+
+// TcpBackend a thrift backend server with a pool of connections. The pool
+// grows to maxConns if all the connections have pending requests and
+// shrinks to minConns if the connections are idle
 type TcpBackend struct {
-	addr              string
-	readiness         Readiness
-	stop              int32
-	conn              net.Conn
-	connected         int32
-	requests          chan *requestWithResponseCallback
-	responseCallbacks *ResponseCallbackMgr
+	addr      string
+	weight    int32
+	readiness Readiness
+	stop      int32
+	minConns  int
+	maxConns  int
+	connLock  sync.Mutex
+	conns     []*backendConn
+	nextConn  uint32
+	latency   *Ewma
+	// the reconnect policy of the connections
+	reconnectPolicy *ReconnectPolicy
+	// nil if the health check is not configured
+	healthChecker *HealthChecker
+	// nil if the slow start is not configured
+	slowStart *SlowStart
+	// the number of connected connections
+	connectedConns int32
+	draining       int32
+	drainTimeout   time.Duration
 }
 
-func NewBackend(backendInfo *BackendInfo) Backend {
+// NewBackend create a backend of the route in proxy
+func NewBackend(backendInfo *BackendInfo, proxyName string, routeName string) Backend {
 	tcpBackend := NewTcpBackend(backendInfo)
+	if backendInfo.HealthCheck != nil {
+		healthChecker, err := NewHealthChecker(tcpBackend, backendInfo.HealthCheck)
+		if err == nil {
+			tcpBackend.healthChecker = healthChecker
+			healthChecker.Start()
+		} else {
+			log.WithFields(log.Fields{"address": backendInfo.Addr, "error": err}).Error("Fail to create health checker")
+		}
+	}
 	if backendInfo.CircuitBreaker != nil {
 		return NewCircuitbreakBackend(tcpBackend,
-			int32(backendInfo.CircuitBreaker.SuccessiveFailures),
-			convertDuration(backendInfo.CircuitBreaker.PauseTime, time.Duration(5)*time.Second))
+			NewCircuitBreaker([]string{proxyName, routeName, backendInfo.Addr}, backendInfo.CircuitBreaker))
 	} else {
 		return tcpBackend
 	}
@@ -106,162 +194,267 @@ func NewBackend(backendInfo *BackendInfo) Backend {
 
 // NewTcpBackend create a thrift backend
 func NewTcpBackend(backendInfo *BackendInfo) *TcpBackend {
+	minConns := backendInfo.MinConnections
+	if minConns <= 0 {
+		minConns = 1
+	}
+	maxConns := backendInfo.MaxConnections
+	if maxConns < minConns {
+		maxConns = minConns
+	}
 	backend := &TcpBackend{addr: backendInfo.Addr,
-		readiness:         createReadiness(backendInfo.Addr, backendInfo.Readiness),
-		stop:              0,
-		conn:              NewErrorConn(),
-		connected:         0,
-		requests:          make(chan *requestWithResponseCallback, 1000),
-		responseCallbacks: NewResponseCallbackMgr()}
-	go backend.startAfterReady()
-	go backend.cleanTimeoutResponse()
+		weight:          int32(normalizeWeight(backendInfo.Weight)),
+		readiness:       NewNullReadiness(),
+		stop:            0,
+		minConns:        minConns,
+		maxConns:        maxConns,
+		conns:           make([]*backendConn, 0),
+		nextConn:        0,
+		latency:         NewEwma(time.Duration(10) * time.Second),
+		reconnectPolicy: NewReconnectPolicy(backendInfo.Reconnect),
+		connectedConns:  0,
+		draining:        0,
+		drainTimeout:    convertDuration(backendInfo.DrainTimeout, defaultDrainTimeout)}
+	if backendInfo.SlowStart != nil {
+		backend.slowStart = NewSlowStart(backendInfo.SlowStart)
+	}
+	if backendInfo.Readiness != nil {
+		prober := NewReadinessProber(backendInfo.Addr,
+			createReadiness(backendInfo.Addr, backendInfo.Readiness),
+			backendInfo.Readiness)
+		prober.Start()
+		backend.readiness = prober
+	}
+	for i := 0; i < minConns; i++ {
+		backend.addConn()
+	}
+	go backend.maintainConns()
 	return backend
 }
 
-func (b *TcpBackend) startAfterReady() {
-	for !b.IsStopped() {
-		if b.readiness.IsReady() {
-			log.WithFields(log.Fields{"address": b.addr}).Info("Server is ready")
-			go b.start()
-			go b.startWriteMessage()
-			break
-		}
-		time.Sleep(time.Duration(2) * time.Second)
+// addConn add a connection to the pool if the pool is not full
+func (b *TcpBackend) addConn() {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	if len(b.conns) < b.maxConns && !b.IsStopped() {
+		b.conns = append(b.conns, newBackendConn(b.addr, b.readiness, b.latency, b.reconnectPolicy, b.onConnectionChange))
 	}
+}
 
+func (b *TcpBackend) getConns() []*backendConn {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	result := make([]*backendConn, len(b.conns))
+	copy(result, b.conns)
+	return result
 }
 
-func (b *TcpBackend) cleanTimeoutResponse() {
+// maintainConns clean the timeout requests and close the idle connections
+// more than minConns
+func (b *TcpBackend) maintainConns() {
 	cleanInterval := time.Duration(10) * time.Millisecond
+	shrinkInterval := time.Second
+	lastShrink := time.Now()
 
 	for !b.IsStopped() {
-		b.responseCallbacks.RemoveTimeout(func(callback ResponseCallback) {
-			callback(nil, requestTimeoutError)
-		})
+		for _, conn := range b.getConns() {
+			conn.cleanTimeoutResponse()
+		}
+		if time.Since(lastShrink) >= shrinkInterval {
+			b.shrinkConns()
+			lastShrink = time.Now()
+		}
 		time.Sleep(cleanInterval)
 	}
 }
 
-func (b *TcpBackend) GetAddr() string {
-	return b.addr
-}
-func (b *TcpBackend) start() {
-	for !b.IsStopped() {
-		log.WithFields(log.Fields{"address": b.addr}).Info("try to connect to backend server")
-		conn, err := net.Dial("tcp", b.addr)
-		if err == nil {
-			b.conn = conn
-			b.setConnected(true)
-			go b.startReadMessage()
-			log.WithFields(log.Fields{"address": b.addr}).Info("Connect to backend server successfully")
-			break
+func (b *TcpBackend) shrinkConns() {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	conns := make([]*backendConn, 0, len(b.conns))
+	for i, conn := range b.conns {
+		if len(b.conns)-(i-len(conns)) > b.minConns && conn.pending() == 0 && conn.idleTime() > connIdleTimeout {
+			log.WithFields(log.Fields{"address": b.addr}).Info("Close idle connection to backend server")
+			conn.close()
 		} else {
-			log.WithFields(log.Fields{"address": b.addr}).Error("Fail to connect backend server")
+			conns = append(conns, conn)
 		}
-		time.Sleep(5 * time.Second)
 	}
+	b.conns = conns
 }
 
-func (b *TcpBackend) startReadMessage() {
-
-	buffer := make([]byte, 4096)
-	respBuffer := NewMessageBuffer()
+// onConnectionChange the slow start is restarted if the backend
+// is connected after all the connections are lost
+func (b *TcpBackend) onConnectionChange(connected bool) {
+	if !connected {
+		atomic.AddInt32(&b.connectedConns, -1)
+	} else if atomic.AddInt32(&b.connectedConns, 1) == 1 && b.slowStart != nil {
+		log.WithFields(log.Fields{"address": b.addr}).Info("Start the slow start of backend")
+		b.slowStart.Restart()
+	}
+}
 
-	for {
-		n, err := b.conn.Read(buffer)
-		if err != nil {
-			b.setConnected(false)
-			log.WithFields(log.Fields{"address": b.addr}).Error("Fail to read response from backend server")
-			break
-		}
-		respBuffer.Add(buffer[0:n])
-		b.processResponseBuffer(respBuffer)
+// GetSlowStartFactor get the factor of weight in slow start
+func (b *TcpBackend) GetSlowStartFactor() float64 {
+	if b.slowStart == nil {
+		return 1
 	}
-	if !b.IsStopped() {
-		go b.startAfterReady()
+	return b.slowStart.GetFactor()
+}
+
+func (b *TcpBackend) GetAddr() string {
+	return b.addr
+}
+
+func (b *TcpBackend) GetWeight() int {
+	return int(atomic.LoadInt32(&b.weight))
+}
+
+func (b *TcpBackend) SetWeight(weight int) {
+	atomic.StoreInt32(&b.weight, int32(normalizeWeight(weight)))
+}
+
+// GetPendingRequests get the number of requests waiting for sending
+// or waiting for the response
+func (b *TcpBackend) GetPendingRequests() int {
+	n := 0
+	for _, conn := range b.getConns() {
+		n += conn.pending()
 	}
+	return n
 }
 
-func (b *TcpBackend) IsConnected() bool {
-	return atomic.LoadInt32(&b.connected) != 0
+// GetLatency get the EWMA of the time between writing the request
+// and getting its response
+func (b *TcpBackend) GetLatency() time.Duration {
+	return time.Duration(b.latency.Get())
 }
 
-func (b *TcpBackend) setConnected(connected bool) {
-	if connected {
-		atomic.StoreInt32(&b.connected, 1)
-	} else {
-		atomic.StoreInt32(&b.connected, 0)
+// GetConnections get the status of connections in the pool
+func (b *TcpBackend) GetConnections() []ConnectionStatus {
+	result := make([]ConnectionStatus, 0)
+	for _, conn := range b.getConns() {
+		result = append(result, conn.getStatus())
 	}
+	return result
 }
 
-// processResponseBuffer process the response from backend server
-func (b *TcpBackend) processResponseBuffer(respBuffer *MessageBuffer) {
-	for {
-		response, err := respBuffer.ExtractMessage()
-		if err != nil {
-			break
-		}
-		seqId, err := response.GetSeqId()
-		if err == nil {
-			respCb, ok := b.getResponseCallback(seqId)
-			if ok {
-				respCb(response, nil)
-			} else {
-				log.Error("Fail to find response callback by seqId")
-			}
-		} else {
-			log.Error("Fail to get the seqId from response")
+// normalizeWeight the weight of backend is 1 if it is not set
+func normalizeWeight(weight int) int {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
+
+// IsConnected check if any connection to the backend is connected
+func (b *TcpBackend) IsConnected() bool {
+	for _, conn := range b.getConns() {
+		if conn.isConnected() {
+			return true
 		}
 	}
+	return false
 }
 
-func (b *TcpBackend) getResponseCallback(seqId int) (ResponseCallback, bool) {
-	return b.responseCallbacks.Remove(seqId)
+// IsHealthy check if the backend passes the health check, it is always
+// healthy if the health check is not configured
+func (b *TcpBackend) IsHealthy() bool {
+	return b.healthChecker == nil || b.healthChecker.IsHealthy()
+}
+
+// IsReady check if the backend passes the readiness probe
+func (b *TcpBackend) IsReady() bool {
+	return b.readiness.IsReady()
 }
 
 // Stop stop the backend
 func (b *TcpBackend) Stop() {
 	if atomic.CompareAndSwapInt32(&b.stop, 0, 1) {
 		log.WithFields(log.Fields{"address": b.addr}).Info("Stop backend")
-		defer b.conn.Close()
+		if b.healthChecker != nil {
+			b.healthChecker.Stop()
+		}
+		if prober, ok := b.readiness.(*ReadinessProber); ok {
+			prober.Stop()
+		}
+		for _, conn := range b.getConns() {
+			conn.close()
+		}
 	} else {
 		log.WithFields(log.Fields{"address": b.addr}).Info("TcpBackend is already stopped")
 	}
 }
 
-func (b *TcpBackend) IsStopped() bool {
-	return atomic.LoadInt32(&b.stop) != 0
+// Drain stop sending new requests to the backend and stop the backend
+// after the pending requests are responded or timeout
+func (b *TcpBackend) Drain() {
+	b.drain(b.Stop)
 }
 
-func (b *TcpBackend) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
-	if !b.IsConnected() {
-		callback(nil, notConnectedError)
+// drain stop sending new requests and call stop after the backend is drained
+func (b *TcpBackend) drain(stop func()) {
+	if atomic.CompareAndSwapInt32(&b.draining, 0, 1) {
+		log.WithFields(log.Fields{"address": b.addr, "pending": b.GetPendingRequests()}).Info("Drain backend")
+		go b.waitDrained(stop)
+	}
+}
+
+func (b *TcpBackend) waitDrained(stop func()) {
+	deadline := time.Now().Add(b.drainTimeout)
+	for !b.IsStopped() && b.GetPendingRequests() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	pending := b.GetPendingRequests()
+	if pending > 0 {
+		log.WithFields(log.Fields{"address": b.addr, "pending": pending}).Error("Timeout to drain backend")
 	} else {
-		b.requests <- newRequestWithResponseCallback(request, requestTimeoutTime, callback)
+		log.WithFields(log.Fields{"address": b.addr}).Info("Backend is drained")
 	}
+	stop()
 }
 
-func (b *TcpBackend) startWriteMessage() {
-	for !b.IsStopped() {
-		select {
-		case requestWithResponseCb, ok := <-b.requests:
-			if !ok {
-				log.WithFields(log.Fields{"address": b.addr}).Error("Fail to send request to backend server")
-				return
-			}
-			seqId, _ := requestWithResponseCb.request.GetSeqId()
-			b.responseCallbacks.Add(seqId,
-				requestWithResponseCb.responseCallback,
-				requestWithResponseCb.requestTimeoutTime)
-
-			err := requestWithResponseCb.request.Write(b.conn)
-			if err == nil {
-				log.WithFields(log.Fields{"address": b.addr}).Info("Succeed to send request to backend server")
-			} else {
-				log.WithFields(log.Fields{"address": b.addr}).Error("Fail to send the request to backend server")
-				requestWithResponseCb.responseCallback(nil, err)
-				return
-			}
+// IsDraining check if the backend is draining or drained
+func (b *TcpBackend) IsDraining() bool {
+	return atomic.LoadInt32(&b.draining) != 0
+}
+
+func (b *TcpBackend) IsStopped() bool {
+	return atomic.LoadInt32(&b.stop) != 0
+}
+
+// Send send the request by the connected connection with fewest pending
+// requests. A new connection is added if all the connections are busy
+func (b *TcpBackend) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	if b.IsDraining() {
+		callback(nil, backendDrainingError)
+		return
+	}
+	conns := b.getConns()
+	n := uint32(len(conns))
+	start := atomic.AddUint32(&b.nextConn, uint32(1))
+	var best *backendConn = nil
+	bestPending := 0
+	for i := uint32(0); i < n; i++ {
+		conn := conns[(start+i)%n]
+		if !conn.isConnected() {
+			continue
+		}
+		pending := conn.pending()
+		if best == nil || pending < bestPending {
+			best = conn
+			bestPending = pending
 		}
 	}
+	if best == nil {
+		callback(nil, notConnectedError)
+		return
+	}
+	if bestPending > 0 && len(conns) < b.maxConns {
+		b.addConn()
+	}
+	best.send(newRequestWithResponseCallback(request, requestTimeoutTime, callback))
 }
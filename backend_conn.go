@@ -0,0 +1,326 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStatus the status of a connection to backend server
+type ConnectionStatus struct {
+	LocalAddr string `json:",omitempty"`
+	Connected bool
+	Pending   int
+	// the retry state if it is not connected
+	Retries   int    `json:",omitempty"`
+	NextRetry string `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+// the interval to check if the backend server becomes ready, the readiness
+// is the result of recent probes so checking it is cheap
+const readinessCheckInterval = time.Duration(100) * time.Millisecond
+
+// backendConn a connection to the backend server. It has its own
+// reader, writer and seqId callback table
+type backendConn struct {
+	addr            string
+	readiness       Readiness
+	latency         *Ewma
+	reconnectPolicy *ReconnectPolicy
+	backoff         *Backoff
+	lastError       atomic.Value
+	// called when the connection is connected or lost
+	onConnectionChange func(connected bool)
+	stop               int32
+	connLock           sync.Mutex
+	conn               net.Conn
+	connected          int32
+	lastActive         int64
+	// the number of requests sent but not responded
+	pendingRequests   int32
+	requests          chan *requestWithResponseCallback
+	responseCallbacks *ResponseCallbackMgr
+}
+
+func newBackendConn(addr string,
+	readiness Readiness,
+	latency *Ewma,
+	reconnectPolicy *ReconnectPolicy,
+	onConnectionChange func(connected bool)) *backendConn {
+	c := &backendConn{addr: addr,
+		onConnectionChange: onConnectionChange,
+		readiness:          readiness,
+		latency:            latency,
+		reconnectPolicy:    reconnectPolicy,
+		backoff:            NewBackoff(reconnectPolicy),
+		stop:               0,
+		conn:               NewErrorConn(),
+		connected:          0,
+		lastActive:         time.Now().UnixNano(),
+		pendingRequests:    0,
+		requests:           make(chan *requestWithResponseCallback, 1000),
+		responseCallbacks:  NewResponseCallbackMgr()}
+	go c.run()
+	return c
+}
+
+// run connect to the backend server after it is ready and re-connect
+// if the connection is lost. The retries are delayed by the reconnect policy
+func (c *backendConn) run() {
+	notReady := false
+	for !c.isStopped() {
+		// the readiness is polled without delaying the next connect
+		if !c.readiness.IsReady() {
+			notReady = true
+			c.lastError.Store("backend server is not ready")
+			c.sleep(readinessCheckInterval)
+			continue
+		}
+		if notReady {
+			notReady = false
+			c.backoff.Reset()
+		}
+		log.WithFields(log.Fields{"address": c.addr}).Info("try to connect to backend server")
+		conn, err := net.DialTimeout("tcp", c.addr, c.reconnectPolicy.dialTimeout)
+		if err != nil {
+			delay := c.backoff.Next()
+			log.WithFields(log.Fields{"address": c.addr, "error": err, "retryAfter": delay.String()}).Error("Fail to connect backend server")
+			c.lastError.Store(err.Error())
+			c.sleep(delay)
+			continue
+		}
+		log.WithFields(log.Fields{"address": c.addr, "local": conn.LocalAddr().String()}).Info("Connect to backend server successfully")
+		c.backoff.Reset()
+		c.lastError.Store("")
+		c.setConn(conn)
+		done := make(chan struct{})
+		go c.startWriteMessage(conn, done)
+		c.startReadMessage(conn)
+		close(done)
+		conn.Close()
+		c.failPendingRequests()
+	}
+	c.failPendingRequests()
+}
+
+// sleep wait for duration, it returns early if the connection is closed
+func (c *backendConn) sleep(duration time.Duration) {
+	step := time.Duration(100) * time.Millisecond
+	for ; duration > 0 && !c.isStopped(); duration -= step {
+		if duration < step {
+			step = duration
+		}
+		time.Sleep(step)
+	}
+}
+
+func (c *backendConn) setConn(conn net.Conn) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	c.conn = conn
+	if c.isStopped() {
+		conn.Close()
+	} else {
+		c.setConnected(true)
+	}
+}
+
+func (c *backendConn) setConnected(connected bool) {
+	var from, to int32 = 1, 0
+	if connected {
+		from, to = 0, 1
+	}
+	if atomic.CompareAndSwapInt32(&c.connected, from, to) {
+		c.onConnectionChange(connected)
+	}
+}
+
+func (c *backendConn) getConn() net.Conn {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.conn
+}
+
+func (c *backendConn) startReadMessage(conn net.Conn) {
+	buffer := make([]byte, 4096)
+	// the transport and protocol of backend server are detected from its responses
+	respBuffer := NewMessageBuffer(AutoTransport, AutoProtocolType)
+
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			c.setConnected(false)
+			if !c.isStopped() {
+				log.WithFields(log.Fields{"address": c.addr}).Error("Fail to read response from backend server")
+			}
+			return
+		}
+		respBuffer.Add(buffer[0:n])
+		err = c.processResponseBuffer(respBuffer)
+		if err != nil {
+			log.WithFields(log.Fields{"address": c.addr, "error": err}).Error("Fail to extract response from backend server")
+			conn.Close()
+		}
+	}
+}
+
+// processResponseBuffer process the response from backend server
+func (c *backendConn) processResponseBuffer(respBuffer *MessageBuffer) error {
+	for {
+		response, err := respBuffer.ExtractMessage()
+		if err == noMessage {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seqId, err := response.GetSeqId()
+		if err == nil {
+			respCb, ok := c.responseCallbacks.Remove(seqId)
+			if ok {
+				respCb(response, nil)
+			} else {
+				log.Error("Fail to find response callback by seqId")
+			}
+		} else {
+			log.Error("Fail to get the seqId from response")
+		}
+	}
+}
+
+// failPendingRequests fail the requests waiting for sending or waiting
+// for response on a lost connection
+func (c *backendConn) failPendingRequests() {
+	c.responseCallbacks.RemoveAll(func(callback ResponseCallback) {
+		callback(nil, notConnectedError)
+	})
+	for {
+		select {
+		case requestWithResponseCb := <-c.requests:
+			requestWithResponseCb.responseCallback(nil, notConnectedError)
+		default:
+			return
+		}
+	}
+}
+
+func (c *backendConn) startWriteMessage(conn net.Conn, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case requestWithResponseCb := <-c.requests:
+			c.writeRequest(conn, requestWithResponseCb)
+		}
+	}
+}
+
+func (c *backendConn) writeRequest(conn net.Conn, requestWithResponseCb *requestWithResponseCallback) {
+	// the request is timeout while waiting in the queue
+	if !time.Now().Before(requestWithResponseCb.requestTimeoutTime) {
+		requestWithResponseCb.responseCallback(nil, requestTimeoutError)
+		return
+	}
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	seqId, _ := requestWithResponseCb.request.GetSeqId()
+	responseCallback := requestWithResponseCb.responseCallback
+	writeTime := time.Now()
+	c.responseCallbacks.Add(seqId,
+		func(response *Message, err error) {
+			if err == nil {
+				c.latency.Observe(float64(time.Since(writeTime)))
+			} else {
+				// the failed request is penalized with the whole time allowed for it,
+				// so a backend failing fast doesn't look faster than the others
+				c.latency.Observe(float64(requestWithResponseCb.requestTimeoutTime.Sub(writeTime)))
+			}
+			responseCallback(response, err)
+		},
+		requestWithResponseCb.requestTimeoutTime)
+
+	err := requestWithResponseCb.request.Write(conn)
+	if err == nil {
+		log.WithFields(log.Fields{"address": c.addr}).Info("Succeed to send request to backend server")
+	} else {
+		log.WithFields(log.Fields{"address": c.addr}).Error("Fail to send the request to backend server")
+		if respCb, ok := c.responseCallbacks.Remove(seqId); ok {
+			respCb(nil, err)
+		}
+		conn.Close()
+	}
+}
+
+// send queue the request for writing, the request fails at once if the
+// connection is not connected or the queue is full
+func (c *backendConn) send(requestWithResponseCb *requestWithResponseCallback) {
+	if !c.isConnected() {
+		requestWithResponseCb.responseCallback(nil, notConnectedError)
+		return
+	}
+	atomic.AddInt32(&c.pendingRequests, 1)
+	responseCallback := requestWithResponseCb.responseCallback
+	requestWithResponseCb.responseCallback = func(response *Message, err error) {
+		atomic.AddInt32(&c.pendingRequests, -1)
+		responseCallback(response, err)
+	}
+	select {
+	case c.requests <- requestWithResponseCb:
+	default:
+		requestWithResponseCb.responseCallback(nil, requestQueueFullError)
+		return
+	}
+	// the connection may be closed by shrinking the pool
+	if c.isStopped() {
+		c.failPendingRequests()
+	}
+}
+
+func (c *backendConn) cleanTimeoutResponse() {
+	c.responseCallbacks.RemoveTimeout(func(callback ResponseCallback) {
+		callback(nil, requestTimeoutError)
+	})
+}
+
+func (c *backendConn) isConnected() bool {
+	return atomic.LoadInt32(&c.connected) != 0
+}
+
+// pending get the number of requests waiting for sending or waiting for the response
+func (c *backendConn) pending() int {
+	return int(atomic.LoadInt32(&c.pendingRequests))
+}
+
+// idleTime get the time since last request is written
+func (c *backendConn) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+func (c *backendConn) getStatus() ConnectionStatus {
+	status := ConnectionStatus{Connected: c.isConnected(), Pending: c.pending()}
+	if status.Connected {
+		status.LocalAddr = c.getConn().LocalAddr().String()
+	} else {
+		retries, nextRetry := c.backoff.GetState()
+		status.Retries = retries
+		if !nextRetry.IsZero() {
+			status.NextRetry = nextRetry.Format(time.RFC3339)
+		}
+		if lastError, ok := c.lastError.Load().(string); ok {
+			status.LastError = lastError
+		}
+	}
+	return status
+}
+
+func (c *backendConn) close() {
+	if atomic.CompareAndSwapInt32(&c.stop, 0, 1) {
+		c.getConn().Close()
+	}
+}
+
+func (c *backendConn) isStopped() bool {
+	return atomic.LoadInt32(&c.stop) != 0
+}
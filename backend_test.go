@@ -0,0 +1,343 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEchoServer start a thrift server which sends every request back
+// as its response after delay
+func startEchoServer(t *testing.T, delay time.Duration) net.Listener {
+	return startThriftServer(t, func(request *Message) *Message {
+		time.Sleep(delay)
+		return request
+	})
+}
+
+// startThriftServer start a thrift server which replies the requests by handler
+func startThriftServer(t *testing.T, handler func(request *Message) *Message) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, 4096)
+				msgBuffer := NewMessageBuffer(AutoTransport, AutoProtocolType)
+				for {
+					n, err := conn.Read(buffer)
+					if err != nil {
+						return
+					}
+					msgBuffer.Add(buffer[0:n])
+					for {
+						msg, err := msgBuffer.ExtractMessage()
+						if err != nil {
+							break
+						}
+						go func() {
+							handler(msg).Write(conn)
+						}()
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// waitFor poll the condition until it is true or the timeout is reached
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	return true
+}
+
+func waitConnected(backend Backend) bool {
+	return waitFor(time.Second, backend.IsConnected)
+}
+
+func TestBackendConnectionPool(t *testing.T) {
+	ln := startEchoServer(t, time.Duration(50)*time.Millisecond)
+	defer ln.Close()
+
+	backend := NewTcpBackend(&BackendInfo{Addr: ln.Addr().String(), MinConnections: 1, MaxConnections: 3})
+	defer backend.Stop()
+	if !waitConnected(backend) {
+		t.Fatal("Fail to connect to the backend")
+	}
+	if len(backend.GetConnections()) != 1 {
+		t.Fatal("The pool should start with the min connections")
+	}
+
+	var wg sync.WaitGroup
+	var failed int32 = 0
+	send := func(seqId int) {
+		wg.Add(1)
+		msg := createInternalErrorException(BinaryProtocolType, true, "test", seqId, "")
+		backend.Send(msg, time.Now().Add(time.Second), func(response *Message, err error) {
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+			wg.Done()
+		})
+	}
+	for i := 0; i < 10; i++ {
+		send(i)
+	}
+	wg.Wait()
+	if failed != 0 {
+		t.Fatalf("%d requests are failed", failed)
+	}
+
+	// the new connections are used after they are connected
+	allConnected := func() bool {
+		for _, conn := range backend.GetConnections() {
+			if !conn.Connected {
+				return false
+			}
+		}
+		return true
+	}
+	if !waitFor(time.Second, allConnected) {
+		t.Fatal("The new connections should be connected")
+	}
+	for i := 10; i < 20; i++ {
+		send(i)
+	}
+	wg.Wait()
+	conns := backend.GetConnections()
+	if len(conns) != 3 {
+		t.Fatalf("The pool should grow to the max connections, but it is %d", len(conns))
+	}
+	for _, conn := range conns {
+		if !conn.Connected || conn.Pending != 0 {
+			t.Errorf("The connection %v is not expected", conn)
+		}
+	}
+}
+
+func TestBackendDrain(t *testing.T) {
+	ln := startEchoServer(t, time.Duration(100)*time.Millisecond)
+	defer ln.Close()
+
+	backend := NewTcpBackend(&BackendInfo{Addr: ln.Addr().String(), DrainTimeout: "1s"})
+	defer backend.Stop()
+	if !waitConnected(backend) {
+		t.Fatal("Fail to connect to the backend")
+	}
+	result := make(chan error, 1)
+	msg := createInternalErrorException(BinaryProtocolType, true, "test", 1, "")
+	backend.Send(msg, time.Now().Add(time.Second), func(response *Message, err error) {
+		result <- err
+	})
+	backend.Drain()
+	backend.Send(msg, time.Now().Add(time.Second), func(response *Message, err error) {
+		if err != backendDrainingError {
+			t.Error("The new request should be rejected by the draining backend")
+		}
+	})
+	if err := <-result; err != nil {
+		t.Fatalf("The in-flight request should be responded, but %v", err)
+	}
+	// the connection is marked disconnected after its reader sees the close
+	if !waitFor(time.Second, func() bool { return backend.IsStopped() && !backend.IsConnected() }) {
+		t.Fatal("The backend should be stopped after it is drained")
+	}
+}
+
+func TestBackendConnSendNotConnected(t *testing.T) {
+	conn := newBackendConn("127.0.0.1:1", NewNullReadiness(), NewEwma(time.Second), NewReconnectPolicy(nil), func(connected bool) {})
+	defer conn.close()
+	result := make(chan error, 1)
+	msg := createInternalErrorException(BinaryProtocolType, true, "test", 1, "")
+	conn.send(newRequestWithResponseCallback(msg, time.Now().Add(time.Second), func(response *Message, err error) {
+		result <- err
+	}))
+	select {
+	case err := <-result:
+		if err != notConnectedError || conn.pending() != 0 {
+			t.Errorf("The request should fail at once, but %v", err)
+		}
+	default:
+		t.Error("The request should not be queued on a disconnected connection")
+	}
+}
+
+func TestBackendConnWaitReady(t *testing.T) {
+	ln := startEchoServer(t, 0)
+	defer ln.Close()
+
+	readiness := &switchReadiness{ready: 0}
+	prober := NewReadinessProber(ln.Addr().String(), readiness, &ReadinessConf{Interval: "10ms"})
+	prober.Start()
+	defer prober.Stop()
+	connected := make(chan bool, 10)
+	conn := newBackendConn(ln.Addr().String(), prober, NewEwma(time.Second), NewReconnectPolicy(nil), func(c bool) {
+		connected <- c
+	})
+	defer conn.close()
+
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	if retries, _ := conn.backoff.GetState(); retries != 0 {
+		t.Fatalf("The waiting for readiness should not consume the reconnect backoff, but %d retries", retries)
+	}
+	atomic.StoreInt32(&readiness.ready, 1)
+	select {
+	case <-connected:
+	case <-time.After(time.Duration(500) * time.Millisecond):
+		t.Fatal("The connection should be connected soon after the backend is ready")
+	}
+
+	// the connection doesn't wait for the probe interval after the first probe
+	prober = NewReadinessProber(ln.Addr().String(), readiness, &ReadinessConf{Interval: "10s"})
+	conn = newBackendConn(ln.Addr().String(), prober, NewEwma(time.Second), NewReconnectPolicy(nil), func(c bool) {
+		connected <- c
+	})
+	defer conn.close()
+	prober.Start()
+	defer prober.Stop()
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("The connection should be connected after the first probe succeeds")
+	}
+}
+
+func TestCircuitbreakBackendDrain(t *testing.T) {
+	ln := startEchoServer(t, 0)
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+	backend := NewBackend(&BackendInfo{Addr: addr, CircuitBreaker: &CircuitbreakConf{SuccessiveFailures: 3}}, "test", "")
+	tcpBackend := backend.(*CircuitbreakBackend).backend.(*TcpBackend)
+	backend.Drain()
+	if !waitFor(time.Second, tcpBackend.IsStopped) {
+		t.Fatal("The backend should be stopped after it is drained")
+	}
+	if circuitBreakerState.DeleteLabelValues("test", "", addr) {
+		t.Error("The circuit breaker should be closed after the backend is drained")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	jitter := 0.1
+	policy := NewReconnectPolicy(&ReconnectConf{InitialDelay: "100ms", Multiplier: 2, MaxDelay: "1s", Jitter: &jitter})
+	backoff := NewBackoff(policy)
+	expected := []int{100, 200, 400, 800, 1000, 1000}
+	for i, n := range expected {
+		delay := backoff.Next()
+		if delay < time.Duration(n*9/10)*time.Millisecond || delay > time.Duration(n*11/10)*time.Millisecond {
+			t.Errorf("The delay %s of retry %d is not expected", delay, i+1)
+		}
+	}
+	if retries, _ := backoff.GetState(); retries != len(expected) {
+		t.Fail()
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay > time.Duration(110)*time.Millisecond {
+		t.Error("The delay should restart from the initial delay")
+	}
+
+	// the jitter can be disabled explicitly
+	jitter = 0
+	backoff = NewBackoff(NewReconnectPolicy(&ReconnectConf{InitialDelay: "100ms", Jitter: &jitter}))
+	if delay := backoff.Next(); delay != time.Duration(100)*time.Millisecond {
+		t.Errorf("The delay %s should not be randomized if jitter is 0", delay)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy int32 = 1
+	ln := startThriftServer(t, func(request *Message) *Message {
+		name, _ := request.GetName()
+		seqId, _ := request.GetSeqId()
+		if atomic.LoadInt32(&healthy) == 0 {
+			return createInternalErrorException(BinaryProtocolType, true, name, seqId, "unhealthy")
+		}
+		writer := NewBinaryProtocol(true)
+		writer.BeginMessage(name, Reply, seqId)
+		writer.BeginStruct()
+		writer.StopField()
+		writer.EndStruct()
+		writer.EndMessage()
+		return writer.ToMessage()
+	})
+	defer ln.Close()
+
+	backend := NewBackend(&BackendInfo{Addr: ln.Addr().String(),
+		HealthCheck: &HealthCheckConf{Method: "ping", Interval: "20ms", UnhealthyThreshold: 2}}, "test", "")
+	defer backend.Stop()
+	if !waitConnected(backend) {
+		t.Fatal("Fail to connect to the backend")
+	}
+	if !waitFor(time.Second, backend.IsHealthy) {
+		t.Fatal("The backend should be healthy")
+	}
+	atomic.StoreInt32(&healthy, 0)
+	if !waitFor(time.Second, func() bool { return !backend.IsHealthy() }) || !backend.IsConnected() {
+		t.Fatal("The backend should be unhealthy without closing the connection")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	if !waitFor(time.Second, backend.IsHealthy) {
+		t.Fatal("The backend should be healthy again")
+	}
+}
+
+func TestBackendConnFailureLatency(t *testing.T) {
+	// the server closes the connection without any response
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 4096))
+				conn.Close()
+			}()
+		}
+	}()
+
+	latency := NewEwma(time.Minute)
+	conn := newBackendConn(ln.Addr().String(), NewNullReadiness(), latency, NewReconnectPolicy(nil), func(connected bool) {})
+	defer conn.close()
+	if !waitFor(time.Second, conn.isConnected) {
+		t.Fatal("Fail to connect to the server")
+	}
+	result := make(chan error, 1)
+	msg := createInternalErrorException(BinaryProtocolType, true, "test", 1, "")
+	conn.send(newRequestWithResponseCallback(msg, time.Now().Add(time.Duration(10)*time.Second), func(response *Message, err error) {
+		result <- err
+	}))
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("The request should fail without response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The request should fail after the connection is closed")
+	}
+	if time.Duration(latency.Get()) < time.Duration(9)*time.Second {
+		t.Errorf("The failed request should be penalized, but the latency is %v", time.Duration(latency.Get()))
+	}
+}
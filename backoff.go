@@ -0,0 +1,97 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ReconnectPolicy how to retry connecting to the backend server
+type ReconnectPolicy struct {
+	initialDelay time.Duration
+	multiplier   float64
+	maxDelay     time.Duration
+	// the delay is randomized in range [delay*(1-jitter), delay*(1+jitter)]
+	jitter      float64
+	dialTimeout time.Duration
+}
+
+// NewReconnectPolicy create a ReconnectPolicy from configuration, the
+// default policy is used if reconnectConf is nil
+func NewReconnectPolicy(reconnectConf *ReconnectConf) *ReconnectPolicy {
+	if reconnectConf == nil {
+		reconnectConf = &ReconnectConf{}
+	}
+	policy := &ReconnectPolicy{initialDelay: convertDuration(reconnectConf.InitialDelay, time.Second),
+		multiplier:  reconnectConf.Multiplier,
+		maxDelay:    convertDuration(reconnectConf.MaxDelay, time.Duration(30)*time.Second),
+		jitter:      0.2,
+		dialTimeout: convertDuration(reconnectConf.DialTimeout, time.Duration(5)*time.Second)}
+	if policy.multiplier < 1 {
+		policy.multiplier = 2
+	}
+	if policy.maxDelay < policy.initialDelay {
+		policy.maxDelay = policy.initialDelay
+	}
+	if reconnectConf.Jitter != nil {
+		if *reconnectConf.Jitter < 0 || *reconnectConf.Jitter > 1 {
+			log.WithFields(log.Fields{"jitter": *reconnectConf.Jitter}).Warn("The jitter should be in range [0, 1], use the default jitter")
+		} else {
+			policy.jitter = *reconnectConf.Jitter
+		}
+	}
+	return policy
+}
+
+// Backoff the retry state of a connection. The delay starts from the
+// initial delay and is multiplied after each failed retry until the max delay
+type Backoff struct {
+	sync.Mutex
+	policy    *ReconnectPolicy
+	retries   int
+	delay     time.Duration
+	nextRetry time.Time
+}
+
+// NewBackoff create a Backoff object with policy
+func NewBackoff(policy *ReconnectPolicy) *Backoff {
+	return &Backoff{policy: policy, retries: 0, delay: 0}
+}
+
+// Next get the delay before next retry
+func (b *Backoff) Next() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.retries == 0 {
+		b.delay = b.policy.initialDelay
+	} else {
+		b.delay = time.Duration(float64(b.delay) * b.policy.multiplier)
+		if b.delay > b.policy.maxDelay {
+			b.delay = b.policy.maxDelay
+		}
+	}
+	b.retries++
+	delay := time.Duration(float64(b.delay) * (1 + b.policy.jitter*(2*rand.Float64()-1)))
+	b.nextRetry = time.Now().Add(delay)
+	return delay
+}
+
+// Reset reset the retry state after connected
+func (b *Backoff) Reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.retries = 0
+	b.delay = 0
+	b.nextRetry = time.Time{}
+}
+
+// GetState get the number of retries and the time of next retry
+func (b *Backoff) GetState() (retries int, nextRetry time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.retries, b.nextRetry
+}
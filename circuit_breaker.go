@@ -0,0 +1,238 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitState the state of circuit breaker
+type CircuitState int
+
+const (
+	// the requests are allowed
+	CircuitClosed CircuitState = iota
+	// the requests are rejected
+	CircuitOpen
+	// a limited number of trial requests are allowed
+	CircuitHalfOpen
+)
+
+// the circuit breakers owning the metrics, a breaker replaced by a new one
+// with same labels doesn't change or remove the metrics of the new one
+var circuitBreakerOwners = struct {
+	sync.Mutex
+	breakers map[string]*CircuitBreaker
+}{breakers: make(map[string]*CircuitBreaker)}
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// CircuitBreaker a closed/open/half-open circuit breaker. The circuit is
+// opened if the consecutive failures or the failure rate in a sliding
+// window of recent requests reaches the threshold. After the open duration,
+// a limited number of trial requests are allowed in half-open state, the
+// circuit is closed if all of them succeed and opened again if any fails
+type CircuitBreaker struct {
+	sync.Mutex
+	name string
+	// the proxy, route and backend labels of metrics
+	labels              []string
+	consecutiveFailures int
+	failureRate         float64
+	minRequests         int
+	openDuration        time.Duration
+	halfOpenRequests    int
+
+	state CircuitState
+	// increased on every transition to ignore the results of requests
+	// allowed in previous state
+	generation int
+	openUntil  time.Time
+	failures   int
+	// the results of recent requests, true for failure
+	window        []bool
+	windowNext    int
+	windowCount   int
+	windowFailure int
+	// the trial requests allowed and succeeded in half-open state
+	trials    int
+	successes int
+}
+
+// NewCircuitBreaker create a CircuitBreaker from configuration, the labels
+// are the proxy, route and backend of the metrics
+func NewCircuitBreaker(labels []string, conf *CircuitbreakConf) *CircuitBreaker {
+	windowSize := conf.WindowSize
+	if windowSize <= 0 {
+		windowSize = 100
+	}
+	minRequests := conf.MinRequests
+	if minRequests <= 0 {
+		minRequests = windowSize / 10
+	}
+	halfOpenRequests := conf.HalfOpenRequests
+	if halfOpenRequests <= 0 {
+		halfOpenRequests = 1
+	}
+	c := &CircuitBreaker{name: labels[len(labels)-1],
+		labels:              labels,
+		consecutiveFailures: conf.SuccessiveFailures,
+		failureRate:         conf.FailureRate / 100,
+		minRequests:         minRequests,
+		openDuration:        convertDuration(conf.PauseTime, time.Duration(5)*time.Second),
+		halfOpenRequests:    halfOpenRequests,
+		state:               CircuitClosed,
+		window:              make([]bool, windowSize)}
+	circuitBreakerOwners.Lock()
+	circuitBreakerOwners.breakers[c.metricsKey()] = c
+	circuitBreakerOwners.Unlock()
+	c.setStateMetrics(CircuitClosed)
+	return c
+}
+
+// Allow check if a request is allowed. If it is allowed, the done
+// must be called with the result of the request
+func (c *CircuitBreaker) Allow() (done func(failed bool), allowed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.state == CircuitOpen && !time.Now().Before(c.openUntil) {
+		c.transit(CircuitHalfOpen)
+	}
+	switch c.state {
+	case CircuitOpen:
+		return nil, false
+	case CircuitHalfOpen:
+		if c.trials >= c.halfOpenRequests {
+			return nil, false
+		}
+		c.trials++
+	}
+	generation := c.generation
+	return func(failed bool) {
+		c.onResult(generation, failed)
+	}, true
+}
+
+func (c *CircuitBreaker) onResult(generation int, failed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	switch c.state {
+	case CircuitClosed:
+		c.record(failed)
+		if c.shouldOpen() {
+			c.transit(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			c.transit(CircuitOpen)
+		} else {
+			c.successes++
+			if c.successes >= c.halfOpenRequests {
+				c.transit(CircuitClosed)
+			}
+		}
+	}
+}
+
+// record add the result of a request to the sliding window
+func (c *CircuitBreaker) record(failed bool) {
+	if failed {
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+	if c.windowCount == len(c.window) {
+		if c.window[c.windowNext] {
+			c.windowFailure--
+		}
+	} else {
+		c.windowCount++
+	}
+	c.window[c.windowNext] = failed
+	if failed {
+		c.windowFailure++
+	}
+	c.windowNext = (c.windowNext + 1) % len(c.window)
+}
+
+func (c *CircuitBreaker) shouldOpen() bool {
+	if c.consecutiveFailures > 0 && c.failures >= c.consecutiveFailures {
+		return true
+	}
+	return c.failureRate > 0 &&
+		c.windowCount >= c.minRequests &&
+		float64(c.windowFailure) >= c.failureRate*float64(c.windowCount)
+}
+
+func (c *CircuitBreaker) transit(state CircuitState) {
+	log.WithFields(log.Fields{"proxy": c.labels[0], "route": c.labels[1], "backend": c.name, "from": c.state.String(), "to": state.String()}).Info("Circuit breaker state is changed")
+	labels := append(append([]string{}, c.labels...), c.state.String(), state.String())
+	circuitBreakerTransitions.WithLabelValues(labels...).Inc()
+	c.setStateMetrics(state)
+
+	c.state = state
+	c.generation++
+	c.failures = 0
+	c.trials = 0
+	c.successes = 0
+	switch state {
+	case CircuitOpen:
+		c.openUntil = time.Now().Add(c.openDuration)
+	case CircuitClosed:
+		c.windowNext = 0
+		c.windowCount = 0
+		c.windowFailure = 0
+	}
+}
+
+// GetState get the current state
+func (c *CircuitBreaker) GetState() CircuitState {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.state == CircuitOpen && !time.Now().Before(c.openUntil) {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Close remove the state and transition metrics of this circuit breaker if they are not owned
+// by a new circuit breaker with same labels
+func (c *CircuitBreaker) Close() {
+	circuitBreakerOwners.Lock()
+	defer circuitBreakerOwners.Unlock()
+	if circuitBreakerOwners.breakers[c.metricsKey()] == c {
+		delete(circuitBreakerOwners.breakers, c.metricsKey())
+		circuitBreakerState.DeleteLabelValues(c.labels...)
+		circuitBreakerTransitions.DeletePartialMatch(prometheus.Labels{"proxy": c.labels[0], "route": c.labels[1], "backend": c.labels[2]})
+	}
+}
+
+// setStateMetrics set the state gauge if it is owned by this circuit breaker
+func (c *CircuitBreaker) setStateMetrics(state CircuitState) {
+	circuitBreakerOwners.Lock()
+	defer circuitBreakerOwners.Unlock()
+	if circuitBreakerOwners.breakers[c.metricsKey()] == c {
+		circuitBreakerState.WithLabelValues(c.labels...).Set(float64(state))
+	}
+}
+
+func (c *CircuitBreaker) metricsKey() string {
+	return strings.Join(c.labels, "/")
+}
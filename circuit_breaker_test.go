@@ -0,0 +1,89 @@
+package main
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+	"time"
+)
+
+func sendToBreaker(breaker *CircuitBreaker, failed bool) bool {
+	done, allowed := breaker.Allow()
+	if allowed {
+		done(failed)
+	}
+	return allowed
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	breaker := NewCircuitBreaker([]string{"test", "", "test-consecutive"}, &CircuitbreakConf{SuccessiveFailures: 3, PauseTime: "50ms", HalfOpenRequests: 2})
+	sendToBreaker(breaker, true)
+	sendToBreaker(breaker, true)
+	sendToBreaker(breaker, false)
+	sendToBreaker(breaker, true)
+	sendToBreaker(breaker, true)
+	if breaker.GetState() != CircuitClosed {
+		t.Fatal("The success should reset the consecutive failures")
+	}
+	sendToBreaker(breaker, true)
+	if breaker.GetState() != CircuitOpen || sendToBreaker(breaker, false) {
+		t.Fatal("The circuit should be opened")
+	}
+
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	// only 2 trial requests are allowed in half-open state
+	done1, allowed1 := breaker.Allow()
+	done2, allowed2 := breaker.Allow()
+	_, allowed3 := breaker.Allow()
+	if !allowed1 || !allowed2 || allowed3 {
+		t.Fatal("Only the trial requests should be allowed")
+	}
+	done1(false)
+	if breaker.GetState() != CircuitHalfOpen {
+		t.Fatal("The circuit should be half-open until all the trials succeed")
+	}
+	done2(false)
+	if breaker.GetState() != CircuitClosed {
+		t.Fatal("The circuit should be closed after the trials succeed")
+	}
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	breaker := NewCircuitBreaker([]string{"test", "", "test-rate"}, &CircuitbreakConf{FailureRate: 50, WindowSize: 10, MinRequests: 10, PauseTime: "50ms"})
+	for i := 0; i < 9; i++ {
+		sendToBreaker(breaker, i%2 == 0)
+	}
+	if breaker.GetState() != CircuitClosed {
+		t.Fatal("The circuit should not be opened before min requests")
+	}
+	sendToBreaker(breaker, false)
+	// 5 of 10 are failed
+	if breaker.GetState() != CircuitOpen {
+		t.Fatal("The circuit should be opened by the failure rate")
+	}
+
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	if !sendToBreaker(breaker, true) || breaker.GetState() != CircuitOpen {
+		t.Fatal("The circuit should be opened again if the trial fails")
+	}
+}
+
+func TestCircuitBreakerReplaced(t *testing.T) {
+	labels := []string{"test", "", "test-replaced"}
+	old := NewCircuitBreaker(labels, &CircuitbreakConf{SuccessiveFailures: 1})
+	breaker := NewCircuitBreaker(labels, &CircuitbreakConf{SuccessiveFailures: 1})
+	sendToBreaker(breaker, true)
+	sendToBreaker(old, false)
+	old.Close()
+	metric := &dto.Metric{}
+	circuitBreakerState.WithLabelValues(labels...).Write(metric)
+	if metric.GetGauge().GetValue() != float64(CircuitOpen) {
+		t.Errorf("The state metrics %v should not be changed by the replaced circuit breaker", metric.GetGauge().GetValue())
+	}
+	breaker.Close()
+	if circuitBreakerState.DeleteLabelValues(labels...) {
+		t.Error("The state metrics should be removed after the circuit breaker is closed")
+	}
+	if circuitBreakerTransitions.DeleteLabelValues(append(labels, "closed", "open")...) {
+		t.Error("The transition metrics should be removed after the circuit breaker is closed")
+	}
+}
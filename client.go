@@ -1,35 +1,56 @@
 package main
 
 import (
-	"errors"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
-	conn             net.Conn
-	requestTimeout   time.Duration
+	conn  net.Conn
+	codec *Codec
+	// the request timeout in nanoseconds
+	requestTimeout   int64
 	seqIdAllocator   *SeqIdAllocator
 	seqIdMapper      *SeqIdMapper
-	loadBalancer     LoadBalancer
+	sender           Sender
+	maxMessageSize   int
 	responses        chan *Message
 	connLostCallback func(*Client)
+	readStopped      int32
+	// the number of requests whose responses are not queued
+	pendingRequests int32
+	closeOnce       sync.Once
+	// closed when the client is closed
+	done chan struct{}
+	// closed after the write routine exits
+	writeDone chan struct{}
 }
 
-// NewClient create a thrift client side delegation
+// NewClient create a thrift client side delegation, the connection is
+// closed if a request is larger than maxMessageSize
 func NewClient(conn net.Conn,
+	codec *Codec,
+	maxMessageSize int,
 	requestTimeout time.Duration,
 	seqIdAllocator *SeqIdAllocator,
-	loadBalancer LoadBalancer,
+	sender Sender,
 	connLostCallback func(*Client)) *Client {
 	client := &Client{conn: conn,
-		requestTimeout:   requestTimeout,
+		codec:            codec,
+		requestTimeout:   int64(requestTimeout),
 		seqIdAllocator:   seqIdAllocator,
 		seqIdMapper:      NewSeqIdMapper(),
-		loadBalancer:     loadBalancer,
+		sender:           sender,
+		maxMessageSize:   maxMessageSize,
 		responses:        make(chan *Message, 1000),
-		connLostCallback: connLostCallback}
+		connLostCallback: connLostCallback,
+		readStopped:      0,
+		pendingRequests:  0,
+		done:             make(chan struct{}),
+		writeDone:        make(chan struct{})}
 
 	go client.startReadRequest()
 	go client.startWriteResponse()
@@ -39,71 +60,101 @@ func NewClient(conn net.Conn,
 
 func (c *Client) startReadRequest() {
 	b := make([]byte, 4096)
-	buffer := NewMessageBuffer()
+	buffer := NewMessageBuffer(c.codec.transport, c.codec.protocol)
+	buffer.SetMaxSize(c.maxMessageSize)
 	for {
 		n, err := c.conn.Read(b)
 		if err != nil {
+			if c.isReadStopped() {
+				// the responses of pending requests are still written until the client is closed
+				log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Info("Stop reading requests from client")
+				break
+			}
 			log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Error("Lost connection with client")
-			close(c.responses)
-			c.connLostCallback(c)
+			c.Close()
 			break
 		}
 		if n > 0 {
 			buffer.Add(b[0:n])
-			c.processRequestBuffer(buffer)
+			err = c.processRequestBuffer(buffer)
+			if err != nil {
+				log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String(), "error": err}).Error("Fail to extract request from client")
+				c.conn.Close()
+			}
 		}
 	}
 	log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Info("Exit read routine")
 }
 
 func (c *Client) startWriteResponse() {
+	defer close(c.writeDone)
+	defer c.conn.Close()
+	defer log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Info("Exit write routine")
 	for {
-		exitLoop := false
 		select {
-		case response, ok := <-c.responses:
-			if !ok {
-				exitLoop = true
-				break
+		case response := <-c.responses:
+			if !c.writeResponse(response) {
+				return
 			}
-			err := response.Write(c.conn)
-			if err != nil {
-				log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Error("Fail to send the response")
-				exitLoop = true
-				break
+		case <-c.done:
+			// write the queued responses before closing the connection
+			for {
+				select {
+				case response := <-c.responses:
+					if !c.writeResponse(response) {
+						return
+					}
+				default:
+					return
+				}
 			}
 		}
-		if exitLoop {
-			break
-		}
 	}
-	log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Info("Exit write routine")
 }
 
-func (c *Client) processRequestBuffer(buffer *MessageBuffer) {
+func (c *Client) writeResponse(response *Message) bool {
+	err := response.Write(c.conn)
+	if err != nil {
+		log.WithFields(log.Fields{"client": c.conn.RemoteAddr().String()}).Error("Fail to send the response")
+		return false
+	}
+	return true
+}
+
+func (c *Client) processRequestBuffer(buffer *MessageBuffer) error {
 	for {
 		request, err := buffer.ExtractMessage()
+		if err == noMessage {
+			return nil
+		}
 		if err != nil {
-			break
+			return err
 		}
 		c.processRequest(request)
 	}
-
 }
 
 func (c *Client) processRequest(request *Message) {
 	newSeqId, err := c.resetSeqId(request)
 	name, _ := request.GetName()
+	protocol := request.GetProtocol()
+	framed := request.isFramed()
 	if err == nil {
-		c.loadBalancer.Send(request, time.Now().Add(c.requestTimeout), func(response *Message, err error) {
-			c.processResponse(name, newSeqId, request.isFramed(), response, err)
+		atomic.AddInt32(&c.pendingRequests, 1)
+		c.sender.Send(request, time.Now().Add(c.getRequestTimeout()), func(response *Message, err error) {
+			c.processResponse(name, newSeqId, protocol, framed, response, err)
 		})
 	} else {
 		log.WithFields(log.Fields{"error": err}).Error("Fail to send request")
-		c.processResponse(name, newSeqId, request.isFramed(), nil, errors.New("No backend servers are available"))
+		// the seqId is not mapped, reply with the seqId of request
+		oldSeqId, _ := request.GetSeqId()
+		c.queueResponse(createInternalErrorException(protocol, framed, name, oldSeqId, "No backend servers are available"))
 	}
 }
 
-func (c *Client) processResponse(name string, newSeqId int, framed bool, response *Message, err error) {
+func (c *Client) processResponse(name string, newSeqId int, protocol ProtocolType, framed bool, response *Message, err error) {
+	// the request is pending until its response is queued
+	defer atomic.AddInt32(&c.pendingRequests, -1)
 
 	oldSeqId, ok := c.seqIdMapper.RemoveMap(newSeqId)
 
@@ -114,17 +165,20 @@ func (c *Client) processResponse(name string, newSeqId int, framed bool, respons
 
 	if err != nil {
 		log.WithFields(log.Fields{"newSeqId": newSeqId, "error": err.Error()}).Error("Fail to send request")
-		response = createInternalErrorException(framed, name, oldSeqId, err.Error())
+		response = createInternalErrorException(protocol, framed, name, oldSeqId, err.Error())
 	}
 
 	response.SetSeqId(oldSeqId)
+	c.queueResponse(response)
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-		}
-	}()
-
-	c.responses <- response
+// queueResponse queue the response for writing, the response is dropped
+// if the client is closed
+func (c *Client) queueResponse(response *Message) {
+	select {
+	case c.responses <- response:
+	case <-c.done:
+	}
 }
 
 func (c *Client) resetSeqId(request *Message) (int, error) {
@@ -144,3 +198,47 @@ func (c *Client) resetSeqId(request *Message) (int, error) {
 func (c *Client) remoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
+
+func (c *Client) getRequestTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.requestTimeout))
+}
+
+// SetRequestTimeout change the timeout of the requests received after it
+func (c *Client) SetRequestTimeout(requestTimeout time.Duration) {
+	atomic.StoreInt64(&c.requestTimeout, int64(requestTimeout))
+}
+
+// StopRead stop reading new requests from the client
+func (c *Client) StopRead() {
+	atomic.StoreInt32(&c.readStopped, 1)
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *Client) isReadStopped() bool {
+	return atomic.LoadInt32(&c.readStopped) != 0
+}
+
+// GetPendingRequests get the number of requests not responded or
+// the responses not written
+func (c *Client) GetPendingRequests() int {
+	return int(atomic.LoadInt32(&c.pendingRequests)) + len(c.responses)
+}
+
+// Close stop the client, the connection is closed after the queued
+// responses are written
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.connLostCallback(c)
+	})
+}
+
+// waitClosed wait until the connection is closed or the deadline is reached,
+// the connection is closed at once if the deadline is reached
+func (c *Client) waitClosed(deadline time.Time) {
+	select {
+	case <-c.writeDone:
+	case <-time.After(time.Until(deadline)):
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// the type ids used in the thrift compact protocol
+const (
+	compactBoolTrue  byte = 1
+	compactBoolFalse byte = 2
+	compactByte      byte = 3
+	compactI16       byte = 4
+	compactI32       byte = 5
+	compactI64       byte = 6
+	compactDouble    byte = 7
+	compactBinary    byte = 8
+	compactList      byte = 9
+	compactSet       byte = 10
+	compactMap       byte = 11
+	compactStruct    byte = 12
+	compactUUID      byte = 13
+)
+
+const compactVersion byte = 1
+
+var fieldTypeToCompactType = map[FieldType]byte{
+	STOP:   0,
+	BOOL:   compactBoolTrue,
+	BYTE:   compactByte,
+	I16:    compactI16,
+	I32:    compactI32,
+	I64:    compactI64,
+	DOUBLE: compactDouble,
+	STRING: compactBinary,
+	LIST:   compactList,
+	SET:    compactSet,
+	MAP:    compactMap,
+	STRUCT: compactStruct,
+	UUID:   compactUUID,
+}
+
+func compactTypeToFieldType(t byte) (FieldType, error) {
+	switch t {
+	case 0:
+		return STOP, nil
+	case compactBoolTrue, compactBoolFalse:
+		return BOOL, nil
+	case compactByte:
+		return BYTE, nil
+	case compactI16:
+		return I16, nil
+	case compactI32:
+		return I32, nil
+	case compactI64:
+		return I64, nil
+	case compactDouble:
+		return DOUBLE, nil
+	case compactBinary:
+		return STRING, nil
+	case compactList:
+		return LIST, nil
+	case compactSet:
+		return SET, nil
+	case compactMap:
+		return MAP, nil
+	case compactStruct:
+		return STRUCT, nil
+	case compactUUID:
+		return UUID, nil
+	default:
+		return STOP, invalidMessage
+	}
+}
+
+func zigzag32(n int32) uint64 {
+	return uint64(uint32((n << 1) ^ (n >> 31)))
+}
+
+func zigzag64(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+// CompactProtocol encode a message in thrift compact protocol
+type CompactProtocol struct {
+	framed       bool
+	buf          *bytes.Buffer
+	lastFieldId  int
+	lastFieldIds []int
+	// the bool field header is written with its value
+	boolFieldId    int
+	hasBoolFieldId bool
+}
+
+func NewCompactProtocol(framed bool) *CompactProtocol {
+	c := &CompactProtocol{framed: framed,
+		buf:          bytes.NewBuffer(make([]byte, 0)),
+		lastFieldId:  0,
+		lastFieldIds: make([]int, 0)}
+	// reserve the frame length, it is filled in ToMessage()
+	if framed {
+		c.buf.Write([]byte{0, 0, 0, 0})
+	}
+	return c
+}
+
+func (cp *CompactProtocol) writeVarint(n uint64) {
+	cp.buf.Write(binary.AppendUvarint(nil, n))
+}
+
+func (cp *CompactProtocol) BeginMessage(name string, msgType MessageType, seqId int) {
+	cp.buf.WriteByte(compactProtocolId)
+	cp.buf.WriteByte(compactVersion | byte(msgType<<5))
+	cp.writeVarint(uint64(uint32(seqId)))
+	cp.WriteString(name)
+}
+
+func (cp *CompactProtocol) EndMessage() {
+}
+
+func (cp *CompactProtocol) BeginStruct() {
+	cp.lastFieldIds = append(cp.lastFieldIds, cp.lastFieldId)
+	cp.lastFieldId = 0
+}
+
+func (cp *CompactProtocol) EndStruct() {
+	n := len(cp.lastFieldIds)
+	if n > 0 {
+		cp.lastFieldId = cp.lastFieldIds[n-1]
+		cp.lastFieldIds = cp.lastFieldIds[0 : n-1]
+	}
+}
+
+func (cp *CompactProtocol) BeginField(fieldType FieldType, fieldId int) {
+	if fieldType == BOOL {
+		cp.boolFieldId = fieldId
+		cp.hasBoolFieldId = true
+	} else {
+		cp.writeFieldHeader(fieldTypeToCompactType[fieldType], fieldId)
+	}
+}
+
+func (cp *CompactProtocol) writeFieldHeader(t byte, fieldId int) {
+	delta := fieldId - cp.lastFieldId
+	if delta > 0 && delta <= 15 {
+		cp.buf.WriteByte(byte(delta<<4) | t)
+	} else {
+		cp.buf.WriteByte(t)
+		cp.writeVarint(zigzag32(int32(int16(fieldId))))
+	}
+	cp.lastFieldId = fieldId
+}
+
+func (cp *CompactProtocol) EndField() {
+}
+
+func (cp *CompactProtocol) StopField() {
+	cp.buf.WriteByte(0)
+}
+
+func (cp *CompactProtocol) BeginMap(keyType FieldType, valueType FieldType, size int) {
+	if size == 0 {
+		cp.buf.WriteByte(0)
+	} else {
+		cp.writeVarint(uint64(size))
+		cp.buf.WriteByte(fieldTypeToCompactType[keyType]<<4 | fieldTypeToCompactType[valueType])
+	}
+}
+
+func (cp *CompactProtocol) EndMap() {
+}
+
+func (cp *CompactProtocol) BeginList(elemType FieldType, size int) {
+	t := fieldTypeToCompactType[elemType]
+	if size <= 14 {
+		cp.buf.WriteByte(byte(size<<4) | t)
+	} else {
+		cp.buf.WriteByte(0xf0 | t)
+		cp.writeVarint(uint64(size))
+	}
+}
+
+func (cp *CompactProtocol) EndList() {
+}
+
+func (cp *CompactProtocol) BeginSet(elemType FieldType, size int) {
+	cp.BeginList(elemType, size)
+}
+
+func (cp *CompactProtocol) EndSet() {
+}
+
+func (cp *CompactProtocol) WriteBool(value bool) {
+	t := compactBoolFalse
+	if value {
+		t = compactBoolTrue
+	}
+	if cp.hasBoolFieldId {
+		cp.hasBoolFieldId = false
+		cp.writeFieldHeader(t, cp.boolFieldId)
+	} else {
+		cp.buf.WriteByte(t)
+	}
+}
+
+func (cp *CompactProtocol) WriteI8(value byte) {
+	cp.buf.WriteByte(value)
+}
+
+func (cp *CompactProtocol) WriteI16(value int16) {
+	cp.writeVarint(zigzag32(int32(value)))
+}
+
+func (cp *CompactProtocol) WriteInt32(value int) {
+	cp.writeVarint(zigzag32(int32(value)))
+}
+
+func (cp *CompactProtocol) WriteI64(value int64) {
+	cp.writeVarint(zigzag64(value))
+}
+
+func (cp *CompactProtocol) WriteDouble(value float64) {
+	cp.buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func (cp *CompactProtocol) WriteString(s string) {
+	cp.WriteBytes([]byte(s))
+}
+
+func (cp *CompactProtocol) WriteBytes(b []byte) {
+	cp.writeVarint(uint64(len(b)))
+	cp.buf.Write(b)
+}
+
+func (cp *CompactProtocol) WriteUUID(b []byte) {
+	cp.buf.Write(b)
+}
+
+func (cp *CompactProtocol) ToMessage() *Message {
+	b := cp.buf.Bytes()
+	if cp.framed {
+		writeInt(b, 0, len(b)-4)
+	}
+	return NewMessage(b)
+}
+
+// CompactProtocolReader read values encoded in thrift compact protocol
+type CompactProtocolReader struct {
+	buf          []byte
+	offset       int
+	lastFieldId  int
+	lastFieldIds []int
+	// the value of a bool field is encoded in the field header
+	boolValue    bool
+	hasBoolValue bool
+}
+
+// NewCompactProtocolReader create a CompactProtocolReader reading from offset of b
+func NewCompactProtocolReader(b []byte, offset int) *CompactProtocolReader {
+	return &CompactProtocolReader{buf: b,
+		offset:       offset,
+		lastFieldId:  0,
+		lastFieldIds: make([]int, 0)}
+}
+
+func (cr *CompactProtocolReader) next(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, invalidMessage
+	}
+	if cr.offset+n > len(cr.buf) {
+		return nil, notEnoughData
+	}
+	b := cr.buf[cr.offset : cr.offset+n]
+	cr.offset += n
+	return b, nil
+}
+
+func (cr *CompactProtocolReader) Offset() int {
+	return cr.offset
+}
+
+func (cr *CompactProtocolReader) readVarint() (uint64, error) {
+	n, size := binary.Uvarint(cr.buf[cr.offset:])
+	if size == 0 {
+		return 0, notEnoughData
+	}
+	if size < 0 {
+		return 0, invalidMessage
+	}
+	cr.offset += size
+	return n, nil
+}
+
+func (cr *CompactProtocolReader) readSize() (int, error) {
+	n, err := cr.readVarint()
+	if err == nil && n > math.MaxInt32 {
+		return 0, invalidMessage
+	}
+	return int(n), err
+}
+
+func (cr *CompactProtocolReader) ReadMessageBegin() (name string, msgType MessageType, seqId int, err error) {
+	b, err := cr.next(2)
+	if err != nil {
+		return
+	}
+	if b[0] != compactProtocolId || b[1]&0x1f != compactVersion {
+		err = invalidMessage
+		return
+	}
+	msgType = MessageType((b[1] >> 5) & 0x07)
+	n, err := cr.readVarint()
+	if err != nil {
+		return
+	}
+	seqId = int(int32(uint32(n)))
+	s, err := cr.ReadBinary()
+	name = string(s)
+	return
+}
+
+func (cr *CompactProtocolReader) ReadStructBegin() error {
+	cr.lastFieldIds = append(cr.lastFieldIds, cr.lastFieldId)
+	cr.lastFieldId = 0
+	return nil
+}
+
+func (cr *CompactProtocolReader) ReadStructEnd() error {
+	n := len(cr.lastFieldIds)
+	if n <= 0 {
+		return invalidMessage
+	}
+	cr.lastFieldId = cr.lastFieldIds[n-1]
+	cr.lastFieldIds = cr.lastFieldIds[0 : n-1]
+	return nil
+}
+
+func (cr *CompactProtocolReader) ReadFieldBegin() (fieldType FieldType, fieldId int, err error) {
+	b, err := cr.ReadByte()
+	if err != nil {
+		return
+	}
+	t := b & 0x0f
+	if t == 0 {
+		return STOP, 0, nil
+	}
+	fieldType, err = compactTypeToFieldType(t)
+	if err != nil {
+		return
+	}
+	delta := int(b >> 4)
+	if delta != 0 {
+		fieldId = cr.lastFieldId + delta
+	} else {
+		var id int16
+		id, err = cr.ReadI16()
+		if err != nil {
+			return
+		}
+		fieldId = int(id)
+	}
+	if fieldType == BOOL {
+		cr.boolValue = t == compactBoolTrue
+		cr.hasBoolValue = true
+	}
+	cr.lastFieldId = fieldId
+	return
+}
+
+func (cr *CompactProtocolReader) ReadMapBegin() (keyType FieldType, valueType FieldType, size int, err error) {
+	size, err = cr.readSize()
+	if err != nil || size == 0 {
+		return
+	}
+	b, err := cr.ReadByte()
+	if err != nil {
+		return
+	}
+	keyType, err = compactTypeToFieldType(b >> 4)
+	if err == nil {
+		valueType, err = compactTypeToFieldType(b & 0x0f)
+	}
+	return
+}
+
+func (cr *CompactProtocolReader) ReadListBegin() (elemType FieldType, size int, err error) {
+	b, err := cr.ReadByte()
+	if err != nil {
+		return
+	}
+	size = int(b >> 4)
+	if size == 15 {
+		size, err = cr.readSize()
+		if err != nil {
+			return
+		}
+	}
+	elemType, err = compactTypeToFieldType(b & 0x0f)
+	return
+}
+
+func (cr *CompactProtocolReader) ReadSetBegin() (elemType FieldType, size int, err error) {
+	return cr.ReadListBegin()
+}
+
+func (cr *CompactProtocolReader) ReadBool() (bool, error) {
+	if cr.hasBoolValue {
+		cr.hasBoolValue = false
+		return cr.boolValue, nil
+	}
+	b, err := cr.ReadByte()
+	return b == compactBoolTrue, err
+}
+
+func (cr *CompactProtocolReader) ReadByte() (byte, error) {
+	b, err := cr.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (cr *CompactProtocolReader) ReadI16() (int16, error) {
+	n, err := cr.ReadI64()
+	return int16(n), err
+}
+
+func (cr *CompactProtocolReader) ReadI32() (int32, error) {
+	n, err := cr.ReadI64()
+	return int32(n), err
+}
+
+func (cr *CompactProtocolReader) ReadI64() (int64, error) {
+	n, err := cr.readVarint()
+	if err != nil {
+		return 0, err
+	}
+	return int64(n>>1) ^ -int64(n&1), nil
+}
+
+func (cr *CompactProtocolReader) ReadDouble() (float64, error) {
+	b, err := cr.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+}
+
+func (cr *CompactProtocolReader) ReadBinary() ([]byte, error) {
+	n, err := cr.readSize()
+	if err != nil {
+		return nil, err
+	}
+	return cr.next(n)
+}
+
+func (cr *CompactProtocolReader) ReadUUID() ([]byte, error) {
+	return cr.next(16)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Ewma the peak sensitive exponentially weighted moving average. The
+// weight of a sample decays with the time elapsed since last sample and
+// a sample greater than the average replaces the average immediately
+type Ewma struct {
+	sync.Mutex
+	decay time.Duration
+	value float64
+	stamp time.Time
+	// the clock to get the time of samples
+	now func() time.Time
+}
+
+// NewEwma create an Ewma object, the weight of old samples drops to
+// 1/e after decay
+func NewEwma(decay time.Duration) *Ewma {
+	return &Ewma{decay: decay, value: 0, stamp: time.Now(), now: time.Now}
+}
+
+// Observe add a sample
+func (e *Ewma) Observe(value float64) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := e.now()
+	if value > e.value {
+		e.value = value
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(e.decay))
+		e.value = e.value*w + value*(1-w)
+	}
+	e.stamp = now
+}
+
+// Get get the average
+func (e *Ewma) Get() float64 {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.value
+}
@@ -2,8 +2,8 @@ package main
 
 import ()
 
-func createInternalErrorException(framed bool, name string, seqId int, errMsg string) *Message {
-	b := NewBinaryProtocol(framed)
+func createInternalErrorException(protocol ProtocolType, framed bool, name string, seqId int, errMsg string) *Message {
+	b := newProtocolWriter(protocol, framed)
 	b.BeginMessage(name, Exception, seqId)
 	b.BeginField(STRING, 1)
 	b.WriteString(errMsg)
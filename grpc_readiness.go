@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// the serving status SERVING of grpc.health.v1.HealthCheckResponse
+const grpcHealthServing = 1
+
+// GrpcReadiness the server is ready if the grpc.health.v1.Health/Check
+// returns SERVING for the service
+type GrpcReadiness struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// NewGrpcReadiness create a GrpcReadiness, the client must support HTTP/2
+func NewGrpcReadiness(baseUrl string, service string, client *http.Client) *GrpcReadiness {
+	return &GrpcReadiness{url: baseUrl + "/grpc.health.v1.Health/Check",
+		service: service,
+		client:  client}
+}
+
+func (g *GrpcReadiness) IsReady() bool {
+	status, err := g.check()
+	return err == nil && status == grpcHealthServing
+}
+
+// check call the health check and return the serving status
+func (g *GrpcReadiness) check() (int, error) {
+	// HealthCheckRequest { string service = 1; }
+	msg := make([]byte, 0)
+	if len(g.service) > 0 {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(g.service)))
+		msg = append(msg, g.service...)
+	}
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequest(http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if len(grpcStatus) <= 0 {
+		// trailers-only response
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	if resp.StatusCode != http.StatusOK || grpcStatus != "0" {
+		return 0, fmt.Errorf("grpc health check is failed with http status %d, grpc status %s", resp.StatusCode, grpcStatus)
+	}
+	if len(b) < 5 || int(binary.BigEndian.Uint32(b[1:5])) != len(b)-5 {
+		return 0, invalidMessage
+	}
+	return parseServingStatus(b[5:])
+}
+
+// parseServingStatus get the status from HealthCheckResponse { ServingStatus status = 1; }
+func parseServingStatus(b []byte) (int, error) {
+	status := 0
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, invalidMessage
+		}
+		b = b[n:]
+		switch tag & 0x07 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return 0, invalidMessage
+			}
+			if tag>>3 == 1 {
+				status = int(v)
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return 0, invalidMessage
+			}
+			b = b[n+int(l):]
+		default:
+			return 0, invalidMessage
+		}
+	}
+	return status, nil
+}
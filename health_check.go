@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// the seqIds of health check requests are allocated from the negative
+// range to avoid conflicting with the seqIds allocated by the proxy
+var healthCheckSeqIdAllocator = &SeqIdAllocator{nextId: math.MinInt32}
+
+// HealthChecker call a thrift method on the backend periodically and mark
+// the backend unhealthy after the consecutive failures reach the threshold
+type HealthChecker struct {
+	backend            Backend
+	method             string
+	protocol           ProtocolType
+	framed             bool
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+	healthy            int32
+	failures           int
+	successes          int
+	stop               int32
+}
+
+// NewHealthChecker create a HealthChecker for backend from configuration
+func NewHealthChecker(backend Backend, conf *HealthCheckConf) (*HealthChecker, error) {
+	protocol, err := parseProtocol(conf.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := parseTransport(conf.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if protocol == AutoProtocolType || transport == AutoTransport {
+		return nil, fmt.Errorf("The protocol and transport of health check must not be auto")
+	}
+	if len(conf.Method) <= 0 {
+		return nil, fmt.Errorf("The method of health check is not set")
+	}
+	h := &HealthChecker{backend: backend,
+		method:             conf.Method,
+		protocol:           protocol,
+		framed:             transport == FramedTransport,
+		interval:           convertDuration(conf.Interval, time.Duration(10)*time.Second),
+		timeout:            convertDuration(conf.Timeout, time.Duration(2)*time.Second),
+		unhealthyThreshold: conf.UnhealthyThreshold,
+		healthyThreshold:   conf.HealthyThreshold,
+		healthy:            1}
+	if h.unhealthyThreshold <= 0 {
+		h.unhealthyThreshold = 3
+	}
+	if h.healthyThreshold <= 0 {
+		h.healthyThreshold = 1
+	}
+	return h, nil
+}
+
+// Start start checking the backend in background
+func (h *HealthChecker) Start() {
+	go func() {
+		for atomic.LoadInt32(&h.stop) == 0 {
+			time.Sleep(h.interval)
+			if atomic.LoadInt32(&h.stop) == 0 && h.backend.IsConnected() {
+				h.check()
+			}
+		}
+	}()
+}
+
+// Stop stop checking the backend
+func (h *HealthChecker) Stop() {
+	atomic.StoreInt32(&h.stop, 1)
+}
+
+// IsHealthy check if the backend is healthy, the backend is healthy before
+// the health check fails
+func (h *HealthChecker) IsHealthy() bool {
+	return atomic.LoadInt32(&h.healthy) != 0
+}
+
+// check call the method and wait for its result
+func (h *HealthChecker) check() {
+	writer := newProtocolWriter(h.protocol, h.framed)
+	writer.BeginMessage(h.method, Call, healthCheckSeqIdAllocator.AllocId())
+	writer.BeginStruct()
+	writer.StopField()
+	writer.EndStruct()
+	writer.EndMessage()
+
+	result := make(chan error, 1)
+	h.backend.Send(writer.ToMessage(), time.Now().Add(h.timeout), func(response *Message, err error) {
+		if err == nil && response.GetType() != int(Reply) {
+			err = fmt.Errorf("The health check gets message with type %d", response.GetType())
+		}
+		result <- err
+	})
+	h.onResult(<-result)
+}
+
+func (h *HealthChecker) onResult(err error) {
+	if err != nil {
+		h.failures++
+		h.successes = 0
+		log.WithFields(log.Fields{"backend": h.backend.GetAddr(), "method": h.method, "error": err}).Error("Fail to check the health of backend")
+		if h.failures >= h.unhealthyThreshold && atomic.CompareAndSwapInt32(&h.healthy, 1, 0) {
+			log.WithFields(log.Fields{"backend": h.backend.GetAddr()}).Error("Backend becomes unhealthy")
+		}
+	} else {
+		h.successes++
+		h.failures = 0
+		if h.successes >= h.healthyThreshold && atomic.CompareAndSwapInt32(&h.healthy, 0, 1) {
+			log.WithFields(log.Fields{"backend": h.backend.GetAddr()}).Info("Backend becomes healthy")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// LeastOutstanding implements LoadBalancer interface, the request
+// is sent to the backend with the fewest pending requests
+type LeastOutstanding struct {
+	*backendPool
+}
+
+// NewLeastOutstanding create a LeastOutstanding object
+func NewLeastOutstanding() *LeastOutstanding {
+	l := &LeastOutstanding{backendPool: newBackendPool()}
+	l.selector = l.selectBackend
+	return l
+}
+
+// Send send a request to one of thrift backend server
+func (l *LeastOutstanding) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	l.sendWithFailover(request, requestTimeoutTime, l.selectBackend, make(map[Backend]bool), callback)
+}
+
+func (l *LeastOutstanding) selectBackend(request *Message, excluded map[Backend]bool) (Backend, error) {
+	backends := l.getSelectableBackends()
+	if len(backends) <= 0 {
+		return nil, noBackendAvailable
+	}
+	var best Backend = nil
+	bestPending := 0.0
+	// number of backends with the fewest pending requests, one
+	// of them is selected randomly to spread the requests
+	ties := 0
+	for _, backend := range backends {
+		if excluded[backend] {
+			continue
+		}
+		// the backend in slow start is loaded more heavily
+		pending := float64(backend.GetPendingRequests()+1) / backend.GetSlowStartFactor()
+		if best == nil || pending < bestPending {
+			best = backend
+			bestPending = pending
+			ties = 1
+		} else if pending == bestPending {
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = backend
+			}
+		}
+	}
+	if best == nil {
+		return nil, failedAllBackends
+	}
+	return best, nil
+}
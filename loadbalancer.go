@@ -2,45 +2,130 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var noBackendAvailable error = errors.New("No backend is available")
 var failedAllBackends error = errors.New("Failed on all the backends")
+var noResolvedBackend error = errors.New("No address is resolved for the backend")
+
+// Sender send a request to thrift server and the response
+// is returned by callback
+type Sender interface {
+	Send(msg *Message, requestTimeoutTime time.Time, callback ResponseCallback)
+}
 
 // LoadBalancer
 type LoadBalancer interface {
 	// add a backend
 	AddBackend(backendInfo *BackendInfo)
 
-	// remove previous added backend
+	// remove previous added backend, the backend is drained before it is stopped
 	RemoveBackend(addr string) error
 
+	// drain the backend without removing it
+	DrainBackend(addr string) error
+
 	// send a message to thrift server
 	Send(msg *Message, requestTimeoutTime time.Time, callback ResponseCallback)
 
+	// send a message to the backend bound in affinity, a backend is
+	// selected and bound if the bound backend is not available
+	SendWithAffinity(affinity *Affinity, msg *Message, requestTimeoutTime time.Time, callback ResponseCallback)
+
 	// get the backends
 	GetAllBackends() []Backend
+
+	// get the added backends in the order they are added, the address
+	// of backend is the one before resolving
+	GetBackendInfos() []BackendInfo
+
+	// get the ejection of an outlier backend, nil if it is not ejected
+	GetEjection(backend Backend) *Ejection
+
+	// stop all the backends and the hostname resolving
+	Stop()
 }
 
-// Roundrobin this class implements LoadBalancer interface
-type Roundrobin struct {
-	resolver    *Resolver
-	backends    *BackendMgr
-	nextBackend uint32
+// LoadBalancerOptions the options to create a LoadBalancer
+type LoadBalancerOptions struct {
+	// the field id of argument used by the consistent hash LoadBalancer
+	HashField int
+	// the outlier detection is disabled if it is nil
+	OutlierDetection *OutlierDetectionConf
+	// the names of proxy and route, they are the labels of backend metrics
+	Proxy string
+	Route string
 }
 
-// NewRoundrobin create a Roundrobin object
-func NewRoundrobin() *Roundrobin {
-	return &Roundrobin{resolver: NewResolver(10),
-		backends:    NewBackendMgr(),
-		nextBackend: 0}
+// NewLoadBalancer create a LoadBalancer by its name
+func NewLoadBalancer(name string, options *LoadBalancerOptions) (LoadBalancer, error) {
+	var loadBalancer LoadBalancer
+	var pool *backendPool
+	switch name {
+	case "", "roundrobin":
+		r := NewRoundrobin()
+		loadBalancer, pool = r, r.backendPool
+	case "weighted-roundrobin":
+		w := NewWeightedRoundrobin()
+		loadBalancer, pool = w, w.backendPool
+	case "least-outstanding":
+		l := NewLeastOutstanding()
+		loadBalancer, pool = l, l.backendPool
+	case "p2c-ewma":
+		p := NewP2CEwma()
+		loadBalancer, pool = p, p.backendPool
+	case "ring-hash":
+		if options.HashField <= 0 {
+			return nil, errors.New("The hashField must be set for ring-hash load balancer")
+		}
+		r := NewRingHash(options.HashField)
+		loadBalancer, pool = r, r.backendPool
+	default:
+		return nil, fmt.Errorf("Unknown load balancer %s", name)
+	}
+	if options.OutlierDetection != nil {
+		pool.outlierDetector = NewOutlierDetector(options.OutlierDetection)
+	}
+	pool.proxyName = options.Proxy
+	pool.routeName = options.Route
+	return loadBalancer, nil
+}
+
+// backendSelector select a backend not in excluded for the request
+type backendSelector = func(request *Message, excluded map[Backend]bool) (Backend, error)
+
+// backendPool manage the backends of a LoadBalancer. If the address of
+// backend is a hostname, it is resolved to IP addresses and a backend
+// is created for each IP address
+type backendPool struct {
+	sync.Mutex
+	resolver *Resolver
+	backends *BackendMgr
+	// select a backend for request, set by the LoadBalancer
+	selector backendSelector
+	// nil if the outlier detection is disabled
+	outlierDetector *OutlierDetector
+	// the added backends in the order they are added
+	backendInfos []*BackendInfo
+	// the names of proxy and route of the backends
+	proxyName string
+	routeName string
+}
+
+func newBackendPool() *backendPool {
+	return &backendPool{resolver: NewResolver(10),
+		backends:     NewBackendMgr(),
+		backendInfos: make([]*BackendInfo, 0)}
 }
 
-// AddBackend add a thrift backend server
-func (r *Roundrobin) AddBackend(backendInfo *BackendInfo) {
+// AddBackend add a thrift backend server, the weight of backend
+// is changed if the backend already exists
+func (p *backendPool) AddBackend(backendInfo *BackendInfo) {
 	hostname, _, err := splitAddr(backendInfo.Addr)
 
 	if err != nil {
@@ -50,79 +135,315 @@ func (r *Roundrobin) AddBackend(backendInfo *BackendInfo) {
 
 	log.WithFields(log.Fields{"address": backendInfo.Addr}).Info("Add backend")
 
+	p.setBackendInfo(backendInfo)
 	if !isIPAddress(hostname) {
-		r.resolver.ResolveHost(backendInfo.Addr, func(hostname string, newAddrs []string, removedAddrs []string) {
-			r.resolvedAddrs(hostname, newAddrs, removedAddrs, backendInfo.Readiness)
-		})
-	} else if !r.backends.Exists(backendInfo.Addr) {
-		backend := NewBackend(backendInfo)
-		r.backends.Add(backend)
+		for _, addr := range p.resolver.GetAddrsOfHost(backendInfo.Addr) {
+			p.updateBackend(addr, backendInfo)
+		}
+		p.resolver.ResolveHost(backendInfo.Addr, p.resolvedAddrs)
+	} else {
+		p.updateBackend(backendInfo.Addr, backendInfo)
+	}
+}
+
+// updateBackend create a backend with addr if it does not exist or it
+// is drained, otherwise the weight of the backend is changed
+func (p *backendPool) updateBackend(addr string, backendInfo *BackendInfo) {
+	backend, err := p.backends.Get(addr)
+	if err == nil && backend.IsDraining() {
+		log.WithFields(log.Fields{"address": addr}).Info("Replace the draining backend")
+		p.backends.Remove(addr)
+	}
+	if err != nil || backend.IsDraining() {
+		info := *backendInfo
+		info.Addr = addr
+		p.backends.Add(NewBackend(&info, p.proxyName, p.routeName))
+	} else if backendInfo.Weight > 0 && backend.GetWeight() != backendInfo.Weight {
+		log.WithFields(log.Fields{"address": addr, "weight": backendInfo.Weight}).Info("Change the weight of backend")
+		backend.SetWeight(backendInfo.Weight)
+	}
+}
+
+func (p *backendPool) setBackendInfo(backendInfo *BackendInfo) {
+	p.Lock()
+	defer p.Unlock()
+	info := *backendInfo
+	for i, t := range p.backendInfos {
+		if t.Addr == info.Addr {
+			p.backendInfos[i] = &info
+			return
+		}
+	}
+	p.backendInfos = append(p.backendInfos, &info)
+}
+
+func (p *backendPool) getBackendInfo(addr string) (*BackendInfo, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for _, info := range p.backendInfos {
+		if info.Addr == addr {
+			return info, true
+		}
 	}
+	return nil, false
 }
 
-func (r *Roundrobin) resolvedAddrs(hostname string, newAddrs []string, removedAddrs []string, readinessConf *ReadinessConf) {
-	for _, addr := range newAddrs {
-		r.AddBackend(&BackendInfo{Addr: addr, Readiness: readinessConf})
+func (p *backendPool) removeBackendInfo(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	for i, info := range p.backendInfos {
+		if info.Addr == addr {
+			p.backendInfos = append(p.backendInfos[0:i], p.backendInfos[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetBackendInfos get the added backends in the order they are added
+func (p *backendPool) GetBackendInfos() []BackendInfo {
+	p.Lock()
+	defer p.Unlock()
+	result := make([]BackendInfo, 0, len(p.backendInfos))
+	for _, info := range p.backendInfos {
+		result = append(result, *info)
+	}
+	return result
+}
+
+func (p *backendPool) resolvedAddrs(hostname string, newAddrs []string, removedAddrs []string) {
+	backendInfo, ok := p.getBackendInfo(hostname)
+	if ok {
+		for _, addr := range newAddrs {
+			p.updateBackend(addr, backendInfo)
+		}
 	}
 	for _, addr := range removedAddrs {
-		r.RemoveBackend(addr)
+		p.removeBackend(addr)
 	}
 }
 
 // RemoveBackend remove a previous added thrift backend server
-func (r *Roundrobin) RemoveBackend(addr string) error {
+func (p *backendPool) RemoveBackend(addr string) error {
 	hostname, _, err := splitAddr(addr)
 
 	if err != nil {
 		return err
 	}
+	p.removeBackendInfo(addr)
 	if !isIPAddress(hostname) {
-		ips := r.resolver.GetAddrsOfHost(addr)
-		r.resolver.StopResolve(addr)
+		ips := p.resolver.GetAddrsOfHost(addr)
+		p.resolver.StopResolve(addr)
 		for _, a := range ips {
-			r.RemoveBackend(a)
+			p.removeBackend(a)
 		}
 		return nil
 	} else {
-		backend, err := r.backends.Remove(addr)
-		if err == nil {
-			backend.Stop()
-		}
+		return p.removeBackend(addr)
+	}
+}
+
+func (p *backendPool) removeBackend(addr string) error {
+	backend, err := p.backends.Remove(addr)
+	if err == nil {
+		backend.Drain()
+	}
+	return err
+}
+
+// DrainBackend drain a previous added thrift backend server, the drained
+// backend is kept until it is removed or added again. It fails if the
+// hostname of backend has no resolved address
+func (p *backendPool) DrainBackend(addr string) error {
+	hostname, _, err := splitAddr(addr)
+
+	if err != nil {
 		return err
 	}
+	addrs := []string{addr}
+	if !isIPAddress(hostname) {
+		addrs = p.resolver.GetAddrsOfHost(addr)
+		if len(addrs) <= 0 {
+			return noResolvedBackend
+		}
+	}
+	for _, a := range addrs {
+		backend, err := p.backends.Get(a)
+		if err != nil {
+			return err
+		}
+		backend.Drain()
+	}
+	return nil
 }
 
-func (r *Roundrobin) GetAllBackends() []Backend {
-	return r.backends.GetAll()
+// Stop stop all the backends at once and the hostname resolving
+func (p *backendPool) Stop() {
+	p.resolver.Stop()
+	for _, backend := range p.backends.GetAll() {
+		backend.Stop()
+	}
 }
 
-// Send send a request to one of thrift backend server
-func (r *Roundrobin) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
-	n := uint32(r.backends.Size())
-	if n <= 0 {
-		callback(nil, noBackendAvailable)
-	} else {
-		index := atomic.AddUint32(&r.nextBackend, uint32(1)) % n
-		r.sendTo(request, requestTimeoutTime, index, n, n, callback)
+func (p *backendPool) GetAllBackends() []Backend {
+	return p.backends.GetAll()
+}
+
+// getSelectableBackends get the backends can be selected by the LoadBalancer
+func (p *backendPool) getSelectableBackends() []Backend {
+	backends := p.backends.GetAll()
+	if p.outlierDetector != nil {
+		p.outlierDetector.Check(backends)
+	}
+	result := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		if p.isSelectable(backend) {
+			result = append(result, backend)
+		}
 	}
+	return result
 }
 
-func (r *Roundrobin) sendTo(request *Message, requestTimeoutTime time.Time, index uint32, leftTimes uint32, total uint32, callback ResponseCallback) {
-	if leftTimes <= 0 {
-		callback(nil, failedAllBackends)
-	} else {
-		backend, err := r.backends.GetIndex(int(index))
+// isSelectable check if the backend can be selected, the not ready, unhealthy
+// or draining backends and ejected outliers are not selectable
+func (p *backendPool) isSelectable(backend Backend) bool {
+	if !backend.IsReady() || !backend.IsHealthy() || backend.IsDraining() {
+		return false
+	}
+	return p.outlierDetector == nil || !p.outlierDetector.IsEjected(backend)
+}
+
+// GetEjection get the ejection of an outlier backend, nil if it is not ejected
+func (p *backendPool) GetEjection(backend Backend) *Ejection {
+	if p.outlierDetector == nil {
+		return nil
+	}
+	return p.outlierDetector.GetEjection(backend)
+}
+
+// sendToBackend send the request to backend and record the result for
+// the outlier detection
+func (p *backendPool) sendToBackend(backend Backend, request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	if p.outlierDetector == nil {
+		backend.Send(request, requestTimeoutTime, callback)
+		return
+	}
+	start := time.Now()
+	backend.Send(request, requestTimeoutTime, func(response *Message, err error) {
+		p.outlierDetector.Observe(backend, time.Since(start), err)
+		callback(response, err)
+	})
+}
+
+// sendWithFailover send the request to the backend selected by selectBackend,
+// if it fails, the request is sent to another backend until all the backends
+// are tried
+func (p *backendPool) sendWithFailover(request *Message,
+	requestTimeoutTime time.Time,
+	selectBackend backendSelector,
+	excluded map[Backend]bool,
+	callback ResponseCallback) {
+	backend, err := selectBackend(request, excluded)
+	if err != nil {
+		callback(nil, err)
+		return
+	}
+	p.sendToBackend(backend, request, requestTimeoutTime, func(response *Message, err error) {
 		if err == nil {
-			backend.Send(request, requestTimeoutTime, func(response *Message, err error) {
-				if err == nil {
-					callback(response, err)
-				} else {
-					log.WithFields(log.Fields{"backend": backend.GetAddr(), "error": err}).Error("Fail to send request")
-					r.sendTo(request, requestTimeoutTime, (index+1)%total, leftTimes-1, total, callback)
-				}
-			})
+			callback(response, err)
+		} else {
+			log.WithFields(log.Fields{"backend": backend.GetAddr(), "error": err}).Error("Fail to send request")
+			excluded[backend] = true
+			p.sendWithFailover(request, requestTimeoutTime, selectBackend, excluded, callback)
+		}
+	})
+}
+
+// SendWithAffinity send the request to the backend bound in affinity. If the
+// bound backend is removed or unavailable, another backend is selected and
+// bound. The error is returned if the request fails on an available backend
+func (p *backendPool) SendWithAffinity(affinity *Affinity,
+	request *Message,
+	requestTimeoutTime time.Time,
+	callback ResponseCallback) {
+	p.sendWithAffinity(affinity, request, requestTimeoutTime, make(map[Backend]bool), callback)
+}
+
+func (p *backendPool) sendWithAffinity(affinity *Affinity,
+	request *Message,
+	requestTimeoutTime time.Time,
+	excluded map[Backend]bool,
+	callback ResponseCallback) {
+	backend := affinity.get(p)
+	if backend == nil || excluded[backend] || !p.isAvailable(backend) {
+		var err error
+		backend, err = p.selector(request, excluded)
+		if err != nil {
+			callback(nil, err)
+			return
+		}
+		log.WithFields(log.Fields{"client": affinity.GetName(), "backend": backend.GetAddr()}).Info("Bind client to backend")
+		affinity.bind(p, backend)
+	}
+	p.sendToBackend(backend, request, requestTimeoutTime, func(response *Message, err error) {
+		if err == nil || p.isAvailable(backend) {
+			// the request may be processed by the backend, it is not safe to re-send it
+			callback(response, err)
 		} else {
-			r.sendTo(request, requestTimeoutTime, (index+1)%total, leftTimes-1, total, callback)
+			log.WithFields(log.Fields{"backend": backend.GetAddr(), "error": err}).Error("Fail to send request")
+			excluded[backend] = true
+			p.sendWithAffinity(affinity, request, requestTimeoutTime, excluded, callback)
 		}
+	})
+}
+
+// isAvailable check if the backend is connected, not removed and selectable
+func (p *backendPool) isAvailable(backend Backend) bool {
+	b, err := p.backends.Get(backend.GetAddr())
+	return err == nil && b == backend && backend.IsConnected() && p.isSelectable(backend)
+}
+
+// Roundrobin this class implements LoadBalancer interface
+type Roundrobin struct {
+	*backendPool
+	nextBackend uint32
+}
+
+// NewRoundrobin create a Roundrobin object
+func NewRoundrobin() *Roundrobin {
+	r := &Roundrobin{backendPool: newBackendPool(),
+		nextBackend: 0}
+	r.selector = r.selectBackend
+	return r
+}
+
+// Send send a request to one of thrift backend server
+func (r *Roundrobin) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	r.sendWithFailover(request, requestTimeoutTime, r.selectBackend, make(map[Backend]bool), callback)
+}
+
+func (r *Roundrobin) selectBackend(request *Message, excluded map[Backend]bool) (Backend, error) {
+	backends := r.getSelectableBackends()
+	n := uint32(len(backends))
+	if n <= 0 {
+		return nil, noBackendAvailable
+	}
+	index := atomic.AddUint32(&r.nextBackend, uint32(1)) % n
+	var first Backend = nil
+	for i := uint32(0); i < n; i++ {
+		backend := backends[(index+i)%n]
+		if excluded[backend] {
+			continue
+		}
+		if slowStartAccepted(backend) {
+			return backend, nil
+		}
+		if first == nil {
+			first = backend
+		}
+	}
+	// all the backends are in slow start and skipped
+	if first != nil {
+		return first, nil
 	}
+	return nil, failedAllBackends
 }
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fakeBackend a Backend replies every request immediately
+type fakeBackend struct {
+	addr      string
+	weight    int
+	err       error
+	count     int
+	pending   int
+	latency   time.Duration
+	down      bool
+	unhealthy bool
+	slowStart float64
+	draining  bool
+}
+
+func newFakeBackend(addr string, weight int) *fakeBackend {
+	return &fakeBackend{addr: addr, weight: weight}
+}
+
+func (f *fakeBackend) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	f.count++
+	if f.err != nil {
+		callback(nil, f.err)
+	} else {
+		callback(request, nil)
+	}
+}
+
+func (f *fakeBackend) GetAddr() string {
+	return f.addr
+}
+
+func (f *fakeBackend) GetWeight() int {
+	return f.weight
+}
+
+func (f *fakeBackend) SetWeight(weight int) {
+	f.weight = weight
+}
+
+func (f *fakeBackend) GetSlowStartFactor() float64 {
+	if f.slowStart <= 0 {
+		return 1
+	}
+	return f.slowStart
+}
+
+func (f *fakeBackend) GetPendingRequests() int {
+	return f.pending
+}
+
+func (f *fakeBackend) GetLatency() time.Duration {
+	return f.latency
+}
+
+func (f *fakeBackend) GetConnections() []ConnectionStatus {
+	return []ConnectionStatus{{Connected: !f.down, Pending: f.pending}}
+}
+
+func (f *fakeBackend) IsConnected() bool {
+	return !f.down
+}
+
+func (f *fakeBackend) IsHealthy() bool {
+	return !f.unhealthy
+}
+
+func (f *fakeBackend) IsReady() bool {
+	return true
+}
+
+func (f *fakeBackend) Drain() {
+	f.draining = true
+}
+
+func (f *fakeBackend) IsDraining() bool {
+	return f.draining
+}
+
+func (f *fakeBackend) Stop() {
+}
+
+func sendRequests(lb LoadBalancer, n int) {
+	for i := 0; i < n; i++ {
+		sendCall(lb, BinaryProtocolType, "test")
+	}
+}
+
+func TestRoundrobinFailover(t *testing.T) {
+	lb := NewRoundrobin()
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b1.err = notConnectedError
+	lb.backends.Add(b1)
+	lb.backends.Add(b2)
+
+	var result error
+	for i := 0; i < 4; i++ {
+		lb.Send(createInternalErrorException(BinaryProtocolType, true, "test", 1, ""), time.Now(), func(response *Message, err error) {
+			result = err
+		})
+		if result != nil {
+			t.Fatal("The request should be sent to the second backend")
+		}
+	}
+	b2.err = notConnectedError
+	lb.Send(createInternalErrorException(BinaryProtocolType, true, "test", 1, ""), time.Now(), func(response *Message, err error) {
+		result = err
+	})
+	if result != failedAllBackends {
+		t.Fail()
+	}
+}
+
+func TestWeightedRoundrobin(t *testing.T) {
+	lb := NewWeightedRoundrobin()
+	b1 := newFakeBackend("127.0.0.1:1", 5)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b3 := newFakeBackend("127.0.0.1:3", 1)
+	lb.backends.Add(b1)
+	lb.backends.Add(b2)
+	lb.backends.Add(b3)
+
+	// the smooth weighted round-robin never selects b1 more than 3 times in a row
+	for i := 0; i < 7; i++ {
+		sendRequests(lb, 1)
+		if i == 2 && b1.count == 3 {
+			t.Error("The selections are not smooth")
+		}
+	}
+	if b1.count != 5 || b2.count != 1 || b3.count != 1 {
+		t.Errorf("Unexpected selections %d, %d, %d", b1.count, b2.count, b3.count)
+	}
+
+	b3.SetWeight(3)
+	sendRequests(lb, 90)
+	if b1.count != 55 || b2.count != 11 || b3.count != 31 {
+		t.Errorf("Unexpected selections after weight changed %d, %d, %d", b1.count, b2.count, b3.count)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	lb := NewLeastOutstanding()
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b3 := newFakeBackend("127.0.0.1:3", 1)
+	b1.pending = 10
+	b2.pending = 2
+	b3.pending = 5
+	lb.backends.Add(b1)
+	lb.backends.Add(b2)
+	lb.backends.Add(b3)
+
+	sendRequests(lb, 3)
+	if b2.count != 3 {
+		t.Fail()
+	}
+	b2.pending = 5
+	sendRequests(lb, 100)
+	if b1.count != 0 || b2.count+b3.count != 103 || b2.count < 23 || b3.count < 20 {
+		t.Errorf("The requests are not spread among the backends with same pending requests %d, %d", b2.count, b3.count)
+	}
+}
+
+func TestP2CEwma(t *testing.T) {
+	lb := NewP2CEwma()
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b1.latency = time.Duration(10) * time.Millisecond
+	b2.latency = time.Duration(2) * time.Millisecond
+	b2.pending = 3
+	lb.backends.Add(b1)
+	lb.backends.Add(b2)
+
+	// 10ms x 1 > 2ms x 4
+	sendRequests(lb, 10)
+	if b2.count != 10 {
+		t.Fail()
+	}
+	b2.pending = 5
+	sendRequests(lb, 10)
+	if b1.count != 10 {
+		t.Fail()
+	}
+
+	// the backend without latency sample is compared by pending requests
+	b2.latency = 0
+	b2.pending = 2
+	b1.pending = 0
+	sendRequests(lb, 10)
+	if b1.count != 20 {
+		t.Errorf("The new backend with more pending requests should not be preferred, %d requests are sent to it", b2.count-10)
+	}
+}
+
+func TestEwma(t *testing.T) {
+	e := NewEwma(time.Duration(10) * time.Millisecond)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+	e.Observe(100)
+	if e.Get() != 100 {
+		t.Error("The peak should be taken immediately")
+	}
+	now = now.Add(time.Duration(50) * time.Millisecond)
+	e.Observe(10)
+	if e.Get() > 11 {
+		t.Errorf("The average %f is not decayed", e.Get())
+	}
+}
+
+func createKeyCall(key string) *Message {
+	writer := NewBinaryProtocol(true)
+	writer.BeginMessage("get", Call, 1)
+	writer.BeginStruct()
+	writer.BeginField(STRING, 1)
+	writer.WriteString(key)
+	writer.StopField()
+	writer.EndStruct()
+	writer.EndMessage()
+	return writer.ToMessage()
+}
+
+// selectKeys get the backend selected for each key
+func selectKeys(lb *RingHash, n int) []Backend {
+	result := make([]Backend, n)
+	for i := 0; i < n; i++ {
+		result[i], _ = lb.selectBackend(createKeyCall(fmt.Sprintf("key-%d", i)), make(map[Backend]bool))
+	}
+	return result
+}
+
+func TestRingHash(t *testing.T) {
+	lb := NewRingHash(1)
+	for i := 1; i <= 4; i++ {
+		lb.backends.Add(newFakeBackend(fmt.Sprintf("127.0.0.1:%d", i), 1))
+	}
+	n := 1000
+	before := selectKeys(lb, n)
+	again := selectKeys(lb, n)
+	for i := 0; i < n; i++ {
+		if before[i] != again[i] {
+			t.Fatal("The same key should be sent to the same backend")
+		}
+	}
+
+	lb.backends.Add(newFakeBackend("127.0.0.1:5", 1))
+	after := selectKeys(lb, n)
+	moved := 0
+	for i := 0; i < n; i++ {
+		if before[i] != after[i] {
+			moved++
+			if after[i].GetAddr() != "127.0.0.1:5" {
+				t.Fatal("The key should only be moved to the new backend")
+			}
+		}
+	}
+	// about 1/5 of the keys should be moved
+	if moved < n/10 || moved > n*3/10 {
+		t.Errorf("%d keys are moved", moved)
+	}
+}
+
+// sendWithAffinity send n requests with affinity and return the backend
+// of the last request
+func sendWithAffinity(lb LoadBalancer, affinity *Affinity, n int) Backend {
+	var result Backend
+	for i := 0; i < n; i++ {
+		before := make(map[Backend]int)
+		for _, backend := range lb.GetAllBackends() {
+			before[backend] = backend.(*fakeBackend).count
+		}
+		lb.SendWithAffinity(affinity, createKeyCall("test"), time.Now(), func(response *Message, err error) {})
+		for _, backend := range lb.GetAllBackends() {
+			if backend.(*fakeBackend).count != before[backend] {
+				if result != nil && result != backend {
+					return nil
+				}
+				result = backend
+			}
+		}
+	}
+	return result
+}
+
+func TestAffinity(t *testing.T) {
+	lb := NewRoundrobin()
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b3 := newFakeBackend("127.0.0.1:3", 1)
+	lb.backends.Add(b1)
+	lb.backends.Add(b2)
+	lb.backends.Add(b3)
+
+	a1 := NewAffinity("client-1")
+	a2 := NewAffinity("client-2")
+	bound1 := sendWithAffinity(lb, a1, 5)
+	bound2 := sendWithAffinity(lb, a2, 5)
+	if bound1 == nil || bound2 == nil || bound1 == bound2 {
+		t.Fatal("The clients should be bound to different backends")
+	}
+
+	// move to another backend if the bound one is down
+	bound1.(*fakeBackend).down = true
+	moved := sendWithAffinity(lb, a1, 5)
+	if moved == nil || moved == bound1 {
+		t.Fatal("The client should be moved to another backend")
+	}
+	bound1.(*fakeBackend).down = false
+	if sendWithAffinity(lb, a1, 5) != moved {
+		t.Fatal("The client should stay on the new backend")
+	}
+
+	// move to another backend if the bound one is unhealthy
+	moved.(*fakeBackend).unhealthy = true
+	if sendWithAffinity(lb, a1, 5) == moved {
+		t.Fatal("The client should be moved from the unhealthy backend")
+	}
+	moved.(*fakeBackend).unhealthy = false
+
+	// the error is returned if the bound backend is still available
+	moved = sendWithAffinity(lb, a1, 1)
+	moved.(*fakeBackend).err = requestTimeoutError
+	var result error
+	lb.SendWithAffinity(a1, createKeyCall("test"), time.Now(), func(response *Message, err error) {
+		result = err
+	})
+	if result != requestTimeoutError {
+		t.Errorf("The error %v is not expected", result)
+	}
+	moved.(*fakeBackend).err = nil
+	if sendWithAffinity(lb, a1, 1) != moved {
+		t.Fatal("The client should stay on the backend after a request fails")
+	}
+
+	// move to another backend if the bound one is removed
+	lb.RemoveBackend(bound2.GetAddr())
+	moved = sendWithAffinity(lb, a2, 5)
+	if moved == nil || moved == bound2 {
+		t.Fatal("The client should be moved after the backend is removed")
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	lb, _ := NewLoadBalancer("roundrobin", &LoadBalancerOptions{OutlierDetection: &OutlierDetectionConf{Interval: "50ms", MinRequests: 5, MaxEjectionPercent: 20}})
+	pool := lb.(*Roundrobin).backendPool
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b3 := newFakeBackend("127.0.0.1:3", 1)
+	b1.err = notConnectedError
+	b2.err = notConnectedError
+	pool.backends.Add(b1)
+	pool.backends.Add(b2)
+	pool.backends.Add(b3)
+	pool.backends.Add(newFakeBackend("127.0.0.1:4", 1))
+	pool.backends.Add(newFakeBackend("127.0.0.1:5", 1))
+
+	sendRequests(lb, 50)
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	sendRequests(lb, 1)
+	e1 := lb.GetEjection(b1)
+	e2 := lb.GetEjection(b2)
+	if (e1 == nil) == (e2 == nil) {
+		t.Fatal("Only one of the failed backends should be ejected by the max ejection percent")
+	}
+	if lb.GetEjection(b3) != nil {
+		t.Fatal("The good backend should not be ejected")
+	}
+	ejected := b1
+	if e1 == nil {
+		ejected = b2
+	}
+	ejection := lb.GetEjection(ejected)
+	ejection.Count = 0
+	if lb.GetEjection(ejected).Count == 0 {
+		t.Fatal("The ejection should be a copy")
+	}
+	count := ejected.count
+	sendRequests(lb, 30)
+	if ejected.count != count {
+		t.Fatal("The ejected backend should not be selected")
+	}
+}
+
+func TestOutlierDetectionLimit(t *testing.T) {
+	// the max ejection percent allows no ejection of 5 backends
+	lb, _ := NewLoadBalancer("roundrobin", &LoadBalancerOptions{OutlierDetection: &OutlierDetectionConf{Interval: "50ms", MinRequests: 5}})
+	pool := lb.(*Roundrobin).backendPool
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b1.err = notConnectedError
+	pool.backends.Add(b1)
+	for i := 2; i <= 5; i++ {
+		pool.backends.Add(newFakeBackend(fmt.Sprintf("127.0.0.1:%d", i), 1))
+	}
+	sendRequests(lb, 50)
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	sendRequests(lb, 1)
+	if lb.GetEjection(b1) != nil {
+		t.Error("The backend should not be ejected beyond the max ejection percent")
+	}
+
+	// the healthy backend is kept even if all the backends can be ejected
+	lb, _ = NewLoadBalancer("roundrobin", &LoadBalancerOptions{OutlierDetection: &OutlierDetectionConf{Interval: "50ms", MinRequests: 5, MaxEjectionPercent: 100}})
+	pool = lb.(*Roundrobin).backendPool
+	b1 = newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b1.err = notConnectedError
+	pool.backends.Add(b1)
+	pool.backends.Add(b2)
+	sendRequests(lb, 20)
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	sendRequests(lb, 1)
+	if lb.GetEjection(b1) == nil || lb.GetEjection(b2) != nil {
+		t.Error("Only the failed backend should be ejected")
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	slowStartRandom = rand.New(rand.NewSource(1)).Float64
+	defer func() { slowStartRandom = rand.Float64 }()
+
+	rr := NewRoundrobin()
+	wrr := NewWeightedRoundrobin()
+	for _, pool := range []*backendPool{rr.backendPool, wrr.backendPool} {
+		b1 := newFakeBackend("127.0.0.1:1", 1)
+		b1.slowStart = 0.2
+		pool.backends.Add(b1)
+		pool.backends.Add(newFakeBackend("127.0.0.1:2", 1))
+	}
+	sendRequests(rr, 1000)
+	sendRequests(wrr, 1000)
+	for _, lb := range []LoadBalancer{rr, wrr} {
+		b1 := lb.GetAllBackends()[0].(*fakeBackend)
+		b2 := lb.GetAllBackends()[1].(*fakeBackend)
+		if b1.count > 250 || b1.count < 50 || b1.count+b2.count != 1000 {
+			t.Errorf("The backend in slow start gets %d and the other gets %d of 1000 requests", b1.count, b2.count)
+		}
+	}
+
+	// the backend in slow start is loaded more heavily
+	lo := NewLeastOutstanding()
+	b1 := newFakeBackend("127.0.0.1:1", 1)
+	b2 := newFakeBackend("127.0.0.1:2", 1)
+	b1.pending = 1
+	b2.pending = 3
+	lo.backends.Add(b1)
+	lo.backends.Add(b2)
+	sendRequests(lo, 1)
+	b1.slowStart = 0.2
+	sendRequests(lo, 1)
+	if b1.count != 1 || b2.count != 1 {
+		t.Errorf("The backend in slow start gets %d and the other gets %d of 2 requests, 1 and 1 are expected", b1.count, b2.count)
+	}
+}
+
+func TestSlowStartFactor(t *testing.T) {
+	linear := NewSlowStart(&SlowStartConf{Window: "100ms", MinWeightPercent: 10})
+	exponential := NewSlowStart(&SlowStartConf{Window: "100ms", Mode: "exponential", MinWeightPercent: 10})
+	if linear.GetFactor() > 0.2 || exponential.GetFactor() > 0.2 {
+		t.Error("The factor should start from the min weight")
+	}
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	if exponential.GetFactor() >= linear.GetFactor() {
+		t.Error("The exponential factor should grow slower at first")
+	}
+	time.Sleep(time.Duration(60) * time.Millisecond)
+	if linear.GetFactor() != 1 || exponential.GetFactor() != 1 {
+		t.Error("The factor should be 1 after the window")
+	}
+	linear.Restart()
+	if linear.GetFactor() > 0.2 {
+		t.Error("The factor should start from the min weight again")
+	}
+}
+
+func TestDrainUnresolvedBackend(t *testing.T) {
+	lb := NewRoundrobin()
+	defer lb.Stop()
+	if err := lb.DrainBackend("unresolved.invalid:9090"); err != noResolvedBackend {
+		t.Errorf("Draining the backend without resolved address should fail, but %v", err)
+	}
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/natefinch/lumberjack.v2"
-	"gopkg.in/yaml.v3"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
+// the default timeout of the requests to backend servers
+const defaultRequestTimeout = time.Duration(60) * time.Second
+
+// the default max size of the requests from clients
+const defaultMaxMessageSize = 16 * 1024 * 1024
+
+// the default time to wait for the pending requests when shutting down
+const defaultShutdownTimeout = time.Duration(30) * time.Second
+
+var shutdownTimeoutError error = errors.New("Fail to finish the pending requests before shutdown timeout")
+var persistConflictError error = errors.New("The --persist and --state-file can't be used together")
+var configRequiredError error = errors.New("The configuration file is required")
+var invalidConfigError error = errors.New("The configuration is not valid")
+
 func createJSONFormatter() *log.JSONFormatter {
 	return &log.JSONFormatter{
 		FieldMap: log.FieldMap{
@@ -63,19 +80,96 @@ func initLog(logFile string, logFormat string, strLevel string, logSize int, bac
 	}
 }
 
+type TLSConf struct {
+	CAFile             string `yaml:"caFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
 type ReadinessConf struct {
-	Protocol string
-	Port     int
-	Path     string `yaml:"path,omitempty"`
+	Protocol         string
+	Port             int
+	Path             string            `yaml:"path,omitempty"`
+	Interval         string            `yaml:"interval,omitempty"`
+	SuccessThreshold int               `yaml:"successThreshold,omitempty"`
+	FailureThreshold int               `yaml:"failureThreshold,omitempty"`
+	Timeout          string            `yaml:"timeout,omitempty"`
+	ExpectedStatus   []int             `yaml:"expectedStatus,omitempty"`
+	BodyContains     string            `yaml:"bodyContains,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	TLS              *TLSConf          `yaml:"tls,omitempty"`
+	Command          []string          `yaml:"command,omitempty"`
+	Service          string            `yaml:"service,omitempty"`
 }
 type CircuitbreakConf struct {
-	SuccessiveFailures int    `yaml:"successiveFailures"`
-	PauseTime          string `yaml:"pauseTime"`
+	SuccessiveFailures int     `yaml:"successiveFailures"`
+	PauseTime          string  `yaml:"pauseTime"`
+	FailureRate        float64 `yaml:"failureRate,omitempty"`
+	WindowSize         int     `yaml:"windowSize,omitempty"`
+	MinRequests        int     `yaml:"minRequests,omitempty"`
+	HalfOpenRequests   int     `yaml:"halfOpenRequests,omitempty"`
+}
+type ReconnectConf struct {
+	InitialDelay string   `yaml:"initialDelay,omitempty"`
+	Multiplier   float64  `yaml:"multiplier,omitempty"`
+	MaxDelay     string   `yaml:"maxDelay,omitempty"`
+	Jitter       *float64 `yaml:"jitter,omitempty"`
+	DialTimeout  string   `yaml:"dialTimeout,omitempty"`
+}
+type OutlierDetectionConf struct {
+	Interval           string  `yaml:"interval,omitempty"`
+	BaseEjectionTime   string  `yaml:"baseEjectionTime,omitempty"`
+	MaxEjectionTime    string  `yaml:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent int     `yaml:"maxEjectionPercent,omitempty"`
+	MinRequests        int     `yaml:"minRequests,omitempty"`
+	Factor             float64 `yaml:"factor,omitempty"`
+	MinRate            float64 `yaml:"minRate,omitempty"`
+	LatencyFactor      float64 `yaml:"latencyFactor,omitempty"`
+}
+type HealthCheckConf struct {
+	Method             string
+	Interval           string `yaml:"interval,omitempty"`
+	Timeout            string `yaml:"timeout,omitempty"`
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold,omitempty"`
+	HealthyThreshold   int    `yaml:"healthyThreshold,omitempty"`
+	Protocol           string `yaml:"protocol,omitempty"`
+	Transport          string `yaml:"transport,omitempty"`
+}
+type SlowStartConf struct {
+	Window           string `yaml:"window,omitempty"`
+	Mode             string `yaml:"mode,omitempty"`
+	MinWeightPercent int    `yaml:"minWeightPercent,omitempty"`
+}
+type ProtocolConf struct {
+	Protocol  string `yaml:"protocol,omitempty"`
+	Transport string `yaml:"transport,omitempty"`
 }
 type BackendInfo struct {
 	Addr           string
+	Weight         int               `yaml:"weight,omitempty"`
+	MinConnections int               `yaml:"minConnections,omitempty"`
+	MaxConnections int               `yaml:"maxConnections,omitempty"`
 	Readiness      *ReadinessConf    `yaml:"readiness,omitempty"`
 	CircuitBreaker *CircuitbreakConf `yaml:"circuitBreaker,omitempty"`
+	Reconnect      *ReconnectConf    `yaml:"reconnect,omitempty"`
+	HealthCheck    *HealthCheckConf  `yaml:"healthCheck,omitempty"`
+	SlowStart      *SlowStartConf    `yaml:"slowStart,omitempty"`
+	DrainTimeout   string            `yaml:"drainTimeout,omitempty"`
+}
+
+type RouteMatchConf struct {
+	Service      string `yaml:"service,omitempty"`
+	Method       string `yaml:"method,omitempty"`
+	MethodPrefix string `yaml:"methodPrefix,omitempty"`
+	MethodRegex  string `yaml:"methodRegex,omitempty"`
+}
+type RouteConf struct {
+	Name               string
+	Match              RouteMatchConf
+	StripServicePrefix bool                  `yaml:"stripServicePrefix,omitempty"`
+	LoadBalancer       string                `yaml:"loadBalancer,omitempty"`
+	HashField          int                   `yaml:"hashField,omitempty"`
+	OutlierDetection   *OutlierDetectionConf `yaml:"outlierDetection,omitempty"`
+	Backends           []BackendInfo
 }
 
 type ProxiesConfigure struct {
@@ -85,31 +179,181 @@ type ProxiesConfigure struct {
 	Metrics struct {
 		Addr string
 	}
-	Proxies []struct {
-		Name           string
-		Listen         string
-		RequestTimeout string `yaml:"requestTimeout,omitempty"`
-		Backends       []BackendInfo
-	}
+	// the time to wait for the pending requests when shutting down
+	ShutdownTimeout string `yaml:"shutdownTimeout,omitempty"`
+	Proxies         []ProxyConf
+}
+
+type ProxyConf struct {
+	Name             string
+	Listen           string
+	Transport        string                `yaml:"transport,omitempty"`
+	Protocol         string                `yaml:"protocol,omitempty"`
+	ClientProtocol   *ProtocolConf         `yaml:"clientProtocol,omitempty"`
+	BackendProtocol  *ProtocolConf         `yaml:"backendProtocol,omitempty"`
+	RequestTimeout   string                `yaml:"requestTimeout,omitempty"`
+	MaxMessageSize   int                   `yaml:"maxMessageSize,omitempty"`
+	LoadBalancer     string                `yaml:"loadBalancer,omitempty"`
+	HashField        int                   `yaml:"hashField,omitempty"`
+	OutlierDetection *OutlierDetectionConf `yaml:"outlierDetection,omitempty"`
+	Affinity         string                `yaml:"affinity,omitempty"`
+	Backends         []BackendInfo
+	Routes           []RouteConf `yaml:"routes,omitempty"`
 }
 
+// loadConfig load the configuration file, an error is returned if any
+// problem is found in the configuration
 func loadConfig(fileName string) (*ProxiesConfigure, error) {
-	f, err := os.Open(fileName)
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return validateConfig(fileName, content)
+}
+
+func parseCodec(protocolConf *ProtocolConf) (*Codec, error) {
+	protocol, err := parseProtocol(protocolConf.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := parseTransport(protocolConf.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return NewCodec(protocol, transport), nil
+}
+
+func createProxy(proxyConf *ProxyConf) (*Proxy, error) {
+	clientProtocol := proxyConf.ClientProtocol
+	if clientProtocol == nil {
+		clientProtocol = &ProtocolConf{Protocol: proxyConf.Protocol, Transport: proxyConf.Transport}
+	}
+	codec, err := parseCodec(clientProtocol)
+	if err != nil {
+		return nil, err
+	}
+	var backendCodec *Codec = nil
+	if proxyConf.BackendProtocol != nil {
+		backendCodec, err = parseCodec(proxyConf.BackendProtocol)
+		if err != nil {
+			return nil, err
+		}
+	}
+	loadBalancer, err := createLoadBalancer(proxyConf.LoadBalancer,
+		&LoadBalancerOptions{HashField: proxyConf.HashField, OutlierDetection: proxyConf.OutlierDetection, Proxy: proxyConf.Name},
+		proxyConf.Backends)
+	if err != nil {
+		return nil, err
+	}
+	// the backends are started when they are added, stop them if the proxy is not created
+	loadBalancers := []LoadBalancer{loadBalancer}
+	created := false
+	defer func() {
+		if !created {
+			for _, lb := range loadBalancers {
+				lb.Stop()
+			}
+		}
+	}()
+	router := NewRouter(loadBalancer)
+	for _, routeConf := range proxyConf.Routes {
+		if len(routeConf.LoadBalancer) <= 0 {
+			routeConf.LoadBalancer = proxyConf.LoadBalancer
+		}
+		if routeConf.HashField <= 0 {
+			routeConf.HashField = proxyConf.HashField
+		}
+		if routeConf.OutlierDetection == nil {
+			routeConf.OutlierDetection = proxyConf.OutlierDetection
+		}
+		route, err := createRoute(proxyConf.Name, &routeConf)
+		if err != nil {
+			return nil, err
+		}
+		loadBalancers = append(loadBalancers, route.GetLoadBalancer())
+		err = router.AddRoute(route)
+		if err != nil {
+			return nil, err
+		}
+	}
+	affinity := false
+	switch proxyConf.Affinity {
+	case "", "none":
+	case "connection":
+		affinity = true
+	default:
+		return nil, fmt.Errorf("Unknown affinity %s", proxyConf.Affinity)
+	}
+	proxy, err := NewProxy(proxyConf.Name,
+		proxyConf.Listen,
+		codec,
+		backendCodec,
+		convertDuration(proxyConf.RequestTimeout, defaultRequestTimeout),
+		router,
+		affinity)
 	if err != nil {
 		return nil, err
 	}
+	if proxyConf.MaxMessageSize > 0 {
+		proxy.SetMaxMessageSize(proxyConf.MaxMessageSize)
+	}
+	proxy.setConf(proxyConf)
+	created = true
+	return proxy, nil
+}
 
-	defer f.Close()
-	r := &ProxiesConfigure{}
+// getRouteName get the name of route, it is the service name if the name is not configured
+func getRouteName(routeConf *RouteConf) string {
+	if len(routeConf.Name) > 0 {
+		return routeConf.Name
+	}
+	return routeConf.Match.Service
+}
 
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(r)
+func createRoute(proxyName string, routeConf *RouteConf) (*Route, error) {
+	matcher, err := NewRouteMatcher(&routeConf.Match)
+	if err != nil {
+		return nil, err
+	}
+	if matcher.IsEmpty() {
+		return nil, fmt.Errorf("No match is configured for route %s", routeConf.Name)
+	}
+	name := getRouteName(routeConf)
+	if len(name) <= 0 {
+		return nil, errors.New("The name of route is not configured")
+	}
+	loadBalancer, err := createLoadBalancer(routeConf.LoadBalancer,
+		&LoadBalancerOptions{HashField: routeConf.HashField,
+			OutlierDetection: routeConf.OutlierDetection,
+			Proxy:            proxyName,
+			Route:            name},
+		routeConf.Backends)
+	if err != nil {
+		return nil, err
+	}
+	return NewRoute(name,
+		matcher,
+		routeConf.StripServicePrefix,
+		loadBalancer), nil
+}
 
+func createLoadBalancer(name string, options *LoadBalancerOptions, backends []BackendInfo) (LoadBalancer, error) {
+	loadBalancer, err := NewLoadBalancer(name, options)
 	if err != nil {
 		return nil, err
 	}
-	return r, nil
+	for _, backend := range backends {
+		loadBalancer.AddBackend(&backend)
+	}
+	return loadBalancer, nil
+}
 
+// getHTTPListenAddr get the listen address of http server, it is ":http" if the addr is empty
+func getHTTPListenAddr(addr string) string {
+	if len(addr) <= 0 {
+		return ":http"
+	}
+	return addr
 }
 
 func startMetrics(addr string) {
@@ -118,10 +362,19 @@ func startMetrics(addr string) {
 	router := mux.NewRouter()
 	router.Handle("/metrics", promhttp.Handler())
 	server.Handler = router
-	go server.ListenAndServe()
-
+	ln, err := listen(getHTTPListenAddr(addr))
+	if err != nil {
+		log.WithFields(log.Fields{"address": addr, "error": err}).Error("Fail to listen on metrics address")
+		return
+	}
+	go server.Serve(ln)
 }
+
 func startProxies(c *cli.Context) error {
+	if len(c.String("config")) <= 0 {
+		cli.ShowAppHelp(c)
+		return configRequiredError
+	}
 
 	config, err := loadConfig(c.String("config"))
 
@@ -134,22 +387,124 @@ func startProxies(c *cli.Context) error {
 	logSize := c.Int("log-size")
 	backups := c.Int("log-backups")
 	initLog(fileName, logFormat, strLevel, logSize, backups)
+	persister, err := createPersister(c)
+	if err != nil {
+		return err
+	}
+	if persister != nil {
+		if err = persister.Merge(config); err != nil {
+			return err
+		}
+	}
+	if err = listenerMgr.loadInherited(); err != nil {
+		return err
+	}
 	proxyMgr := NewProxyMgr()
-	admin := NewAdmin(config.Admin.Addr, proxyMgr)
-	defTimeout := time.Duration(60) * time.Second
-	for _, proxy := range config.Proxies {
-		roundRobin := NewRoundrobin()
-		for _, backend := range proxy.Backends {
-			roundRobin.AddBackend(&backend)
+	reloader := NewReloader(c.String("config"), config, proxyMgr)
+	admin := NewAdmin(config.Admin.Addr, proxyMgr, reloader)
+	if persister != nil {
+		reloader.SetPersister(persister)
+		admin.SetPersister(persister)
+	}
+	for _, proxyConf := range config.Proxies {
+		err := proxyMgr.CreateProxy(&proxyConf)
+		if err != nil {
+			return err
 		}
-		proxyMgr.AddProxy(NewProxy(proxy.Name, proxy.Listen, convertDuration(proxy.RequestTimeout, defTimeout), roundRobin))
 	}
 
 	admin.Start()
 	startMetrics(config.Metrics.Addr)
+	listenerMgr.closeInherited()
+	notifyUpgradeReady()
+
+	go proxyMgr.Run()
+	if c.Bool("watch") {
+		go reloader.Watch()
+	}
+
+	return handleSignals(admin, proxyMgr, reloader)
+}
+
+// validateConfigFiles check the configuration files in arguments or the
+// configuration file of --config flag
+func validateConfigFiles(c *cli.Context) error {
+	fileNames := c.Args().Slice()
+	if len(fileNames) <= 0 && len(c.String("config")) > 0 {
+		fileNames = []string{c.String("config")}
+	}
+	if len(fileNames) <= 0 {
+		return configRequiredError
+	}
+	valid := true
+	for _, fileName := range fileNames {
+		if _, err := loadConfig(fileName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			valid = false
+		} else {
+			fmt.Printf("The configuration %s is valid\n", fileName)
+		}
+	}
+	if !valid {
+		return invalidConfigError
+	}
+	return nil
+}
+
+// createPersister create the Persister by the --persist or --state-file flag,
+// nil if the changes made through the admin API are not saved
+func createPersister(c *cli.Context) (*Persister, error) {
+	stateFile := c.String("state-file")
+	if c.Bool("persist") && len(stateFile) > 0 {
+		return nil, persistConflictError
+	}
+	if c.Bool("persist") {
+		return NewPersister(c.String("config"), false), nil
+	}
+	if len(stateFile) > 0 {
+		return NewPersister(stateFile, true), nil
+	}
+	return nil, nil
+}
 
-	proxyMgr.Run()
+// handleSignals reload the configuration after receiving SIGHUP and shutdown
+// the proxies gracefully after receiving SIGTERM or SIGINT, an error is
+// returned if the pending requests are not finished in timeout. After
+// receiving SIGUSR2, the proxies are shutdown gracefully if the listeners
+// are passed to the upgraded process
+func handleSignals(admin *Admin, proxyMgr *ProxyMgr, reloader *Reloader) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT}, upgradeSignals...)...)
+	for {
+		sig := <-signals
+		if sig == syscall.SIGHUP {
+			reloader.Reload()
+			continue
+		}
+		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+			log.WithFields(log.Fields{"signal": sig.String()}).Info("Receive signal to shutdown")
+			break
+		}
+		err := startUpgradedProcess()
+		if err == nil {
+			log.Info("Stop accepting connections after upgrade")
+			for _, proxy := range proxyMgr.GetAllProxy() {
+				proxy.StopAccept()
+			}
+			listenerMgr.closeAll()
+			break
+		}
+		log.WithFields(log.Fields{"error": err}).Error("Fail to upgrade")
+	}
+	signal.Stop(signals)
 
+	timeout := reloader.GetShutdownTimeout()
+	log.WithFields(log.Fields{"timeout": timeout.String()}).Info("Shutdown the proxies")
+	admin.SetReady(false)
+	if !proxyMgr.Shutdown(timeout) {
+		return shutdownTimeoutError
+	}
+	log.Info("All the proxies are shutdown")
 	return nil
 }
 
@@ -159,10 +514,9 @@ func main() {
 		Usage: "a proxy between thrift client and thrift backend servers",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "config",
-				Aliases:  []string{"c"},
-				Required: true,
-				Usage:    "Load configuration from `FILE`",
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Load configuration from `FILE`",
 			},
 			&cli.StringFlag{
 				Name:  "log-file",
@@ -181,16 +535,37 @@ func main() {
 				Usage: "size of log file in Megabytes",
 				Value: 50,
 			},
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "reload the configuration if the file is changed",
+			},
+			&cli.BoolFlag{
+				Name:  "persist",
+				Usage: "write the changes made through the admin API back to the configuration file",
+			},
+			&cli.StringFlag{
+				Name:  "state-file",
+				Usage: "save the changes made through the admin API to `FILE` which is merged to the configuration at startup",
+			},
 			&cli.IntFlag{
 				Name:  "log-backups",
 				Usage: "number of log rotate files",
 				Value: 10,
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "check the configuration files without starting the proxies",
+				ArgsUsage: "[FILE...]",
+				Action:    validateConfigFiles,
+			},
+		},
 		Action: startProxies,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Fail to start application")
+		log.WithFields(log.Fields{"error": err}).Error("Fail to run application")
+		os.Exit(1)
 	}
 }
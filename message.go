@@ -1,15 +1,24 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"strconv"
 )
 
 var noMessage error = errors.New("no message")
+var noSuchField error = errors.New("no such field")
+var messageTooLargeError error = errors.New("the message is too large")
 
 type MessageBuffer struct {
-	buffer []byte
+	transport Transport
+	protocol  ProtocolType
+	buffer    []byte
+	// the max size of a message, no limit if it is not greater than 0
+	maxSize int
 }
 
 type Message struct {
@@ -44,9 +53,23 @@ func writeInt(b []byte, offset int, value int) error {
 	return nil
 }
 
-// NewMessageBuffer creaate a MessageBuffer object
-func NewMessageBuffer() *MessageBuffer {
-	return &MessageBuffer{buffer: make([]byte, 0)}
+// NewMessageBuffer creaate a MessageBuffer object, the messages
+// are extracted according to the transport and protocol. If the
+// AutoTransport or AutoProtocolType is used, it is detected from
+// the first message
+func NewMessageBuffer(transport Transport, protocol ProtocolType) *MessageBuffer {
+	return &MessageBuffer{transport: transport, protocol: protocol, buffer: make([]byte, 0)}
+}
+
+// SetMaxSize set the max size of a message, the messageTooLargeError is
+// returned when extracting a message larger than it
+func (p *MessageBuffer) SetMaxSize(maxSize int) {
+	p.maxSize = maxSize
+}
+
+// isTooLarge check if a message with n bytes is larger than the max size
+func (p *MessageBuffer) isTooLarge(n int) bool {
+	return p.maxSize > 0 && n > p.maxSize
 }
 
 // Add add data to the buffer
@@ -54,10 +77,39 @@ func (p *MessageBuffer) Add(b []byte) {
 	p.buffer = append(p.buffer, b...)
 }
 
-// ExtractMessage extract a thrift message
+// ExtractMessage extract a thrift message. The noMessage error is returned
+// if there is no complete message in the buffer and the invalidMessage error
+// is returned if the data in the buffer is not a thrift message
 func (p *MessageBuffer) ExtractMessage() (*Message, error) {
+	if len(p.buffer) <= 0 {
+		return nil, noMessage
+	}
+	if p.transport == AutoTransport {
+		if isMessageBegin(p.buffer[0]) {
+			p.transport = BufferedTransport
+		} else {
+			p.transport = FramedTransport
+		}
+	}
+	var msg *Message
+	var err error
+	if p.transport == BufferedTransport {
+		msg, err = p.extractUnframedMessage()
+	} else {
+		msg, err = p.extractFramedMessage()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, p.checkProtocol(msg)
+}
+
+func (p *MessageBuffer) extractFramedMessage() (*Message, error) {
 	if len(p.buffer) > 4 {
 		n, err := readInt(p.buffer, 0)
+		if err == nil && p.isTooLarge(n) {
+			return nil, messageTooLargeError
+		}
 		if err == nil && len(p.buffer) >= 4+n {
 			msg := &Message{buffer: p.buffer[0 : 4+n]}
 			p.buffer = p.buffer[4+n:]
@@ -67,6 +119,75 @@ func (p *MessageBuffer) ExtractMessage() (*Message, error) {
 	return nil, noMessage
 }
 
+// extractUnframedMessage walk through the message to find where it ends.
+// The message is parsed from its beginning after more data is added, so
+// the incomplete message can't exceed the max size
+func (p *MessageBuffer) extractUnframedMessage() (*Message, error) {
+	protocol, err := detectProtocol(p.buffer[0])
+	if err != nil {
+		return nil, err
+	}
+	reader := newProtocolReader(protocol, p.buffer, 0)
+	err = skipMessage(reader)
+	if err == notEnoughData && p.isTooLarge(len(p.buffer)) {
+		return nil, messageTooLargeError
+	}
+	if err == notEnoughData {
+		return nil, noMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := reader.Offset()
+	if p.isTooLarge(n) {
+		return nil, messageTooLargeError
+	}
+	msg := &Message{buffer: p.buffer[0:n]}
+	p.buffer = p.buffer[n:]
+	return msg, nil
+}
+
+// checkProtocol check if the message is encoded in the protocol of this
+// buffer and its header is complete. If AutoProtocolType is used, the
+// protocol of first message is used for all the following messages
+func (p *MessageBuffer) checkProtocol(msg *Message) error {
+	offset := msg.headerOffset()
+	if offset >= len(msg.buffer) {
+		return invalidMessage
+	}
+	protocol, err := detectProtocol(msg.buffer[offset])
+	if err != nil {
+		return err
+	}
+	_, msgType, _, err := newProtocolReader(protocol, msg.buffer, offset).ReadMessageBegin()
+	if err != nil || msgType < Call || msgType > Oneway {
+		return invalidMessage
+	}
+	if p.protocol == AutoProtocolType {
+		p.protocol = protocol
+	} else if p.protocol != protocol {
+		return invalidMessage
+	}
+	return nil
+}
+
+// isMessageBegin check if b is the first byte of an unframed message
+func isMessageBegin(b byte) bool {
+	return b == binaryProtocolId || b == compactProtocolId
+}
+
+// detectProtocol detect the protocol from the first byte of message
+func detectProtocol(b byte) (ProtocolType, error) {
+	switch b {
+	case binaryProtocolId:
+		return BinaryProtocolType, nil
+	case compactProtocolId:
+		return CompactProtocolType, nil
+	default:
+		return BinaryProtocolType, invalidMessage
+	}
+}
+
 // NewMessage create a thrift Message object
 func NewMessage(b []byte) *Message {
 	return &Message{buffer: b}
@@ -83,7 +204,20 @@ func (m *Message) Hex() string {
 	return hex.Dump(m.buffer)
 }
 
+// GetProtocol get the protocol of the message
+func (m *Message) GetProtocol() ProtocolType {
+	offset := m.headerOffset()
+	if offset < len(m.buffer) && m.buffer[offset] == compactProtocolId {
+		return CompactProtocolType
+	}
+	return BinaryProtocolType
+}
+
 func (m *Message) GetSeqId() (int, error) {
+	if m.GetProtocol() == CompactProtocolType {
+		_, _, seqId, err := m.readCompactHeader()
+		return seqId, err
+	}
 	offset, err := m.getSeqIdOffset()
 	if err == nil {
 		return readInt(m.buffer, offset)
@@ -93,6 +227,9 @@ func (m *Message) GetSeqId() (int, error) {
 }
 
 func (m *Message) SetSeqId(seqId int) error {
+	if m.GetProtocol() == CompactProtocolType {
+		return m.setCompactSeqId(seqId)
+	}
 	offset, err := m.getSeqIdOffset()
 	if err == nil {
 		return writeInt(m.buffer, offset, seqId)
@@ -104,15 +241,16 @@ func (m *Message) SetSeqId(seqId int) error {
 
 // GetName get the name of call
 func (m *Message) GetName() (string, error) {
-	offset := 4
-	if m.isFramed() {
-		offset += 4
+	if m.GetProtocol() == CompactProtocolType {
+		name, _, _, err := m.readCompactHeader()
+		return name, err
 	}
-	n, err := readInt(m.buffer, offset)
-	if err == nil {
-		return string(m.buffer[offset+4 : offset+4+n]), nil
+	reader := NewBinaryProtocolReader(m.buffer, m.headerOffset()+4)
+	name, err := reader.ReadBinary()
+	if err != nil {
+		return "", err
 	}
-	return "", err
+	return string(name), nil
 }
 
 // GetType get message type
@@ -121,17 +259,93 @@ func (m *Message) GetName() (string, error) {
 // - 3, Exception
 // - 4, Oneway
 func (m *Message) GetType() int {
-	offset := 0
-	if m.isFramed() {
-		offset += 4
+	if m.GetProtocol() == CompactProtocolType {
+		_, msgType, _, _ := m.readCompactHeader()
+		return int(msgType)
+	}
+	offset := m.headerOffset() + 3
+	if offset >= len(m.buffer) {
+		return 0
 	}
-	return int(m.buffer[offset+3] & 0xff)
+	return int(m.buffer[offset] & 0xff)
 }
 
 func (m *Message) isFramed() bool {
 	return m.buffer[0]&0x80 != 0x80
 }
 
+// headerOffset get the offset of the message header
+func (m *Message) headerOffset() int {
+	if m.isFramed() {
+		return 4
+	}
+	return 0
+}
+
+func (m *Message) readCompactHeader() (name string, msgType MessageType, seqId int, err error) {
+	reader := NewCompactProtocolReader(m.buffer, m.headerOffset())
+	return reader.ReadMessageBegin()
+}
+
+// setCompactSeqId replace the varint encoded seqId in the compact message
+func (m *Message) setCompactSeqId(seqId int) error {
+	offset := m.headerOffset() + 2
+	if offset >= len(m.buffer) {
+		return invalidMessage
+	}
+	_, n := binary.Uvarint(m.buffer[offset:])
+	if n <= 0 {
+		return invalidMessage
+	}
+	b := binary.AppendUvarint(nil, uint64(uint32(seqId)))
+	if len(b) == n {
+		copy(m.buffer[offset:], b)
+	} else {
+		m.replace(offset, offset+n, b)
+	}
+	return nil
+}
+
+// SetName change the name of call
+func (m *Message) SetName(name string) error {
+	var b []byte
+	var reader ProtocolReader
+	start := m.headerOffset()
+	if m.GetProtocol() == CompactProtocolType {
+		// the name is after the varint encoded seqId
+		compactReader := NewCompactProtocolReader(m.buffer, start+2)
+		if _, err := compactReader.readVarint(); err != nil {
+			return err
+		}
+		start = compactReader.Offset()
+		reader = compactReader
+		b = binary.AppendUvarint(nil, uint64(len(name)))
+	} else {
+		start += 4
+		reader = NewBinaryProtocolReader(m.buffer, start)
+		b = make([]byte, 4)
+		writeInt(b, 0, len(name))
+	}
+	if _, err := reader.ReadBinary(); err != nil {
+		return err
+	}
+	m.replace(start, reader.Offset(), append(b, name...))
+	return nil
+}
+
+// replace replace the bytes between start and end with b. A new buffer is
+// allocated instead of overwriting the data following this message
+func (m *Message) replace(start int, end int, b []byte) {
+	buffer := make([]byte, 0, len(m.buffer)-(end-start)+len(b))
+	buffer = append(buffer, m.buffer[0:start]...)
+	buffer = append(buffer, b...)
+	buffer = append(buffer, m.buffer[end:]...)
+	if m.isFramed() {
+		writeInt(buffer, 0, len(buffer)-4)
+	}
+	m.buffer = buffer
+}
+
 func (m *Message) getSeqIdOffset() (int, error) {
 	offset := 4
 	if m.isFramed() {
@@ -144,3 +358,63 @@ func (m *Message) getSeqIdOffset() (int, error) {
 	}
 	return offset + 4 + n, nil
 }
+
+// GetArgField get the value of field fieldId in the argument struct of
+// the call as a string. The integers are formatted in decimal so the
+// value is same in binary and compact protocol
+func (m *Message) GetArgField(fieldId int) (string, error) {
+	reader := newProtocolReader(m.GetProtocol(), m.buffer, m.headerOffset())
+	if _, _, _, err := reader.ReadMessageBegin(); err != nil {
+		return "", err
+	}
+	if err := reader.ReadStructBegin(); err != nil {
+		return "", err
+	}
+	for {
+		fieldType, id, err := reader.ReadFieldBegin()
+		if err != nil {
+			return "", err
+		}
+		if fieldType == STOP {
+			return "", noSuchField
+		}
+		if id == fieldId {
+			return readFieldAsString(reader, fieldType)
+		}
+		if err = skipValue(reader, fieldType, 1); err != nil {
+			return "", err
+		}
+	}
+}
+
+// readFieldAsString read a value of basic type and format it as string
+func readFieldAsString(reader ProtocolReader, fieldType FieldType) (string, error) {
+	switch fieldType {
+	case BOOL:
+		v, err := reader.ReadBool()
+		return strconv.FormatBool(v), err
+	case BYTE:
+		v, err := reader.ReadByte()
+		return strconv.Itoa(int(int8(v))), err
+	case I16:
+		v, err := reader.ReadI16()
+		return strconv.Itoa(int(v)), err
+	case I32:
+		v, err := reader.ReadI32()
+		return strconv.Itoa(int(v)), err
+	case I64:
+		v, err := reader.ReadI64()
+		return strconv.FormatInt(v, 10), err
+	case DOUBLE:
+		v, err := reader.ReadDouble()
+		return strconv.FormatFloat(v, 'g', -1, 64), err
+	case STRING:
+		v, err := reader.ReadBinary()
+		return string(v), err
+	case UUID:
+		v, err := reader.ReadUUID()
+		return hex.EncodeToString(v), err
+	default:
+		return "", fmt.Errorf("The field type %d is not supported", fieldType)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"testing"
+)
+
+// createUnframedCall create an unframed binary call with a list<i32> and a nested struct
+func createUnframedCall(name string, seqId int) []byte {
+	b := NewBinaryProtocol(false)
+	b.BeginMessage(name, Call, seqId)
+	b.BeginField(LIST, 1)
+	b.buf.Write([]byte{I32, 0, 0, 0, 2})
+	b.WriteInt32(10)
+	b.WriteInt32(20)
+	b.BeginField(STRUCT, 2)
+	b.BeginField(STRING, 1)
+	b.WriteString("hello")
+	b.StopField()
+	b.StopField()
+	return b.ToMessage().buffer
+}
+
+func TestExtractFramedMessage(t *testing.T) {
+	msg := createInternalErrorException(BinaryProtocolType, true, "test", 5, "error")
+	buffer := NewMessageBuffer(FramedTransport, BinaryProtocolType)
+	buffer.Add(msg.buffer)
+	r, err := buffer.ExtractMessage()
+	if err != nil || len(r.buffer) != len(msg.buffer) {
+		t.Fail()
+	}
+}
+
+func TestExtractUnframedMessage(t *testing.T) {
+	call := createUnframedCall("test", 7)
+	buffer := NewMessageBuffer(BufferedTransport, BinaryProtocolType)
+
+	// feed the message byte by byte
+	for i := 0; i < len(call)-1; i++ {
+		buffer.Add(call[i : i+1])
+		if _, err := buffer.ExtractMessage(); err != noMessage {
+			t.Fatalf("Expect no message at %d, got %v", i, err)
+		}
+	}
+	buffer.Add(call[len(call)-1:])
+	buffer.Add(createUnframedCall("next", 8))
+	msg, err := buffer.ExtractMessage()
+	if err != nil || len(msg.buffer) != len(call) {
+		t.Fatal("Fail to extract the unframed message")
+	}
+	name, _ := msg.GetName()
+	seqId, _ := msg.GetSeqId()
+	if name != "test" || seqId != 7 {
+		t.Fail()
+	}
+	msg, err = buffer.ExtractMessage()
+	if err != nil {
+		t.Fatal("Fail to extract the second unframed message")
+	}
+	name, _ = msg.GetName()
+	if name != "next" {
+		t.Fail()
+	}
+}
+
+func TestExtractInvalidUnframedMessage(t *testing.T) {
+	buffer := NewMessageBuffer(BufferedTransport, BinaryProtocolType)
+	buffer.Add([]byte{0, 0, 0, 10, 1, 2})
+	if _, err := buffer.ExtractMessage(); err != invalidMessage {
+		t.Fail()
+	}
+}
+
+func TestExtractTruncatedFramedMessage(t *testing.T) {
+	// the length of name is 0x7fffffff in a 12 bytes frame
+	frame := []byte{0, 0, 0, 0x0c, 0x80, 1, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	buffer := NewMessageBuffer(AutoTransport, AutoProtocolType)
+	buffer.Add(frame)
+	if _, err := buffer.ExtractMessage(); err != invalidMessage {
+		t.Errorf("The truncated message should be rejected, but %v", err)
+	}
+	msg := NewMessage(frame)
+	if _, err := msg.GetName(); err == nil {
+		t.Error("The name out of the message should not be read")
+	}
+
+	// the message type is not valid
+	frame = []byte{0, 0, 0, 0x0c, 0x80, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0, 1}
+	buffer = NewMessageBuffer(AutoTransport, AutoProtocolType)
+	buffer.Add(frame)
+	if _, err := buffer.ExtractMessage(); err != invalidMessage {
+		t.Errorf("The message with invalid type should be rejected, but %v", err)
+	}
+}
+
+func TestExtractTooLargeMessage(t *testing.T) {
+	call := createUnframedCall("test", 7)
+	buffer := NewMessageBuffer(BufferedTransport, BinaryProtocolType)
+	buffer.SetMaxSize(len(call) - 1)
+	buffer.Add(call[0 : len(call)-1])
+	if _, err := buffer.ExtractMessage(); err != noMessage {
+		t.Fatalf("The incomplete message within max size should be waited, but %v", err)
+	}
+	buffer.Add(call[len(call)-1:])
+	if _, err := buffer.ExtractMessage(); err != messageTooLargeError {
+		t.Errorf("The unframed message larger than max size should be rejected, but %v", err)
+	}
+
+	// the frame is rejected by its length before it is received
+	buffer = NewMessageBuffer(FramedTransport, BinaryProtocolType)
+	buffer.SetMaxSize(1024)
+	buffer.Add([]byte{0, 0x10, 0, 0, 0x80})
+	if _, err := buffer.ExtractMessage(); err != messageTooLargeError {
+		t.Errorf("The frame larger than max size should be rejected, but %v", err)
+	}
+}
+
+func TestAutoDetectTransport(t *testing.T) {
+	buffer := NewMessageBuffer(AutoTransport, AutoProtocolType)
+	buffer.Add(createUnframedCall("test", 1))
+	if _, err := buffer.ExtractMessage(); err != nil || buffer.transport != BufferedTransport {
+		t.Fail()
+	}
+
+	buffer = NewMessageBuffer(AutoTransport, AutoProtocolType)
+	buffer.Add(createInternalErrorException(BinaryProtocolType, true, "test", 1, "error").buffer)
+	if _, err := buffer.ExtractMessage(); err != nil || buffer.transport != FramedTransport {
+		t.Fail()
+	}
+}
+
+func TestCompactMessageHeader(t *testing.T) {
+	msg := createInternalErrorException(CompactProtocolType, true, "getUser", 5, "error")
+	if msg.GetProtocol() != CompactProtocolType || msg.GetType() != Exception {
+		t.Fail()
+	}
+	name, err := msg.GetName()
+	if err != nil || name != "getUser" {
+		t.Fail()
+	}
+	// the varint seqId becomes longer
+	if err := msg.SetSeqId(300000); err != nil {
+		t.Fatal(err)
+	}
+	seqId, err := msg.GetSeqId()
+	if err != nil || seqId != 300000 {
+		t.Fail()
+	}
+	n, _ := readInt(msg.buffer, 0)
+	if n != len(msg.buffer)-4 {
+		t.Error("Frame length is not updated")
+	}
+	name, _ = msg.GetName()
+	if name != "getUser" {
+		t.Fail()
+	}
+}
+
+func TestExtractUnframedCompactMessage(t *testing.T) {
+	b := createInternalErrorException(CompactProtocolType, false, "test", 9, "error").buffer
+	buffer := NewMessageBuffer(BufferedTransport, AutoProtocolType)
+	buffer.Add(b[0 : len(b)-1])
+	if _, err := buffer.ExtractMessage(); err != noMessage {
+		t.Fail()
+	}
+	buffer.Add(b[len(b)-1:])
+	msg, err := buffer.ExtractMessage()
+	if err != nil || len(msg.buffer) != len(b) || buffer.protocol != CompactProtocolType {
+		t.Fatal("Fail to extract the compact message")
+	}
+	seqId, _ := msg.GetSeqId()
+	if seqId != 9 {
+		t.Fail()
+	}
+
+	// the protocol is fixed after the first message
+	buffer.Add(createUnframedCall("test", 10))
+	if _, err := buffer.ExtractMessage(); err != invalidMessage {
+		t.Fail()
+	}
+}
+
+func TestGetArgField(t *testing.T) {
+	for _, msg := range []*Message{writeTestMessage(NewBinaryProtocol(true)), writeTestMessage(NewCompactProtocol(false))} {
+		v, err := msg.GetArgField(3)
+		if err != nil || v != "-1234567890123" {
+			t.Errorf("Fail to get i64 field: %s, %v", v, err)
+		}
+		v, err = msg.GetArgField(40)
+		if err != nil || v != "3.25" {
+			t.Errorf("Fail to get double field: %s, %v", v, err)
+		}
+		if _, err = msg.GetArgField(9); err != noSuchField {
+			t.Fail()
+		}
+	}
+}
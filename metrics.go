@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thriftproxy_circuit_breaker_state",
+		Help: "The state of backend circuit breaker, 0: closed, 1: open, 2: half-open",
+	}, []string{"proxy", "route", "backend"})
+
+	circuitBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "thriftproxy_circuit_breaker_transitions_total",
+		Help: "The number of state transitions of backend circuit breaker",
+	}, []string{"proxy", "route", "backend", "from", "to"})
+)
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Ejection the ejection of an outlier backend
+type Ejection struct {
+	Reason string
+	Until  time.Time
+	// the number of times the backend is ejected
+	Count int
+}
+
+// outlierStats the results of requests to a backend in an interval
+type outlierStats struct {
+	requests  int
+	errors    int
+	timeouts  int
+	successes int
+	latency   time.Duration
+	// the number of ejections, decreased if the backend is good in an interval
+	ejections int
+	ejection  *Ejection
+}
+
+// OutlierDetector detect the outlier backends by comparing the error rate,
+// timeout rate and latency of each backend with the average of other backends
+// in the pool. The outliers are ejected from the load balancing for a time
+// which grows on repeated ejections
+type OutlierDetector struct {
+	sync.Mutex
+	interval           time.Duration
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+	minRequests        int
+	factor             float64
+	minRate            float64
+	latencyFactor      float64
+
+	lastCheck time.Time
+	stats     map[Backend]*outlierStats
+}
+
+// NewOutlierDetector create an OutlierDetector from configuration
+func NewOutlierDetector(conf *OutlierDetectionConf) *OutlierDetector {
+	d := &OutlierDetector{interval: convertDuration(conf.Interval, time.Duration(10)*time.Second),
+		baseEjectionTime:   convertDuration(conf.BaseEjectionTime, time.Duration(30)*time.Second),
+		maxEjectionTime:    convertDuration(conf.MaxEjectionTime, time.Duration(300)*time.Second),
+		maxEjectionPercent: conf.MaxEjectionPercent,
+		minRequests:        conf.MinRequests,
+		factor:             conf.Factor,
+		minRate:            conf.MinRate / 100,
+		latencyFactor:      conf.LatencyFactor,
+		lastCheck:          time.Now(),
+		stats:              make(map[Backend]*outlierStats)}
+	if d.maxEjectionPercent <= 0 {
+		d.maxEjectionPercent = 10
+	}
+	if d.minRequests <= 0 {
+		d.minRequests = 10
+	}
+	if d.factor <= 1 {
+		d.factor = 2
+	}
+	if d.minRate <= 0 {
+		d.minRate = 0.1
+	}
+	if d.latencyFactor <= 0 {
+		d.latencyFactor = 3
+	}
+	return d
+}
+
+func (d *OutlierDetector) getStats(backend Backend) *outlierStats {
+	stats, ok := d.stats[backend]
+	if !ok {
+		stats = &outlierStats{}
+		d.stats[backend] = stats
+	}
+	return stats
+}
+
+// Observe record the result of a request sent to backend
+func (d *OutlierDetector) Observe(backend Backend, latency time.Duration, err error) {
+	if err == circuitBreakError {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	stats := d.getStats(backend)
+	stats.requests++
+	if err == requestTimeoutError {
+		stats.timeouts++
+	} else if err != nil {
+		stats.errors++
+	} else {
+		stats.successes++
+		stats.latency += latency
+	}
+}
+
+// IsEjected check if the backend is ejected
+func (d *OutlierDetector) IsEjected(backend Backend) bool {
+	return d.GetEjection(backend) != nil
+}
+
+// GetEjection get a copy of the ejection of backend, nil if it is not ejected
+func (d *OutlierDetector) GetEjection(backend Backend) *Ejection {
+	d.Lock()
+	defer d.Unlock()
+
+	stats, ok := d.stats[backend]
+	if !ok || stats.ejection == nil || stats.ejection.Until.Before(time.Now()) {
+		return nil
+	}
+	ejection := *stats.ejection
+	return &ejection
+}
+
+// Check detect the outliers in backends if the interval is passed
+func (d *OutlierDetector) Check(backends []Backend) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastCheck) < d.interval {
+		return
+	}
+	d.lastCheck = now
+
+	// forget the removed backends
+	stats := make(map[Backend]*outlierStats)
+	for _, backend := range backends {
+		stats[backend] = d.getStats(backend)
+	}
+	d.stats = stats
+
+	ejected := 0
+	for _, backend := range backends {
+		s := stats[backend]
+		if s.ejection != nil {
+			if s.ejection.Until.After(now) {
+				ejected++
+			} else {
+				log.WithFields(log.Fields{"backend": backend.GetAddr()}).Info("Return the ejected backend")
+				s.ejection = nil
+			}
+		}
+	}
+	for _, backend := range backends {
+		s := stats[backend]
+		if s.ejection != nil {
+			continue
+		}
+		reason := d.detect(backend, stats)
+		if len(reason) <= 0 {
+			if s.ejections > 0 && s.requests >= d.minRequests {
+				s.ejections--
+			}
+			continue
+		}
+		// at least one backend is kept for load balancing
+		if (ejected+1)*100 > d.maxEjectionPercent*len(backends) || ejected+1 >= len(backends) {
+			log.WithFields(log.Fields{"backend": backend.GetAddr(), "reason": reason}).Info("Outlier backend is not ejected because too many backends are ejected")
+			continue
+		}
+		s.ejections++
+		ejectionTime := d.baseEjectionTime * time.Duration(s.ejections)
+		if ejectionTime > d.maxEjectionTime {
+			ejectionTime = d.maxEjectionTime
+		}
+		s.ejection = &Ejection{Reason: reason, Until: now.Add(ejectionTime), Count: s.ejections}
+		ejected++
+		log.WithFields(log.Fields{"backend": backend.GetAddr(), "reason": reason, "ejectionTime": ejectionTime.String()}).Info("Eject outlier backend")
+	}
+	for _, s := range stats {
+		s.requests = 0
+		s.errors = 0
+		s.timeouts = 0
+		s.successes = 0
+		s.latency = 0
+	}
+}
+
+// detect check if the backend is an outlier by comparing it with the average
+// of other backends, the reason is returned if it is an outlier
+func (d *OutlierDetector) detect(backend Backend, stats map[Backend]*outlierStats) string {
+	s := stats[backend]
+	if s.requests < d.minRequests {
+		return ""
+	}
+	errorRate := float64(s.errors) / float64(s.requests)
+	timeoutRate := float64(s.timeouts) / float64(s.requests)
+
+	others := 0
+	othersErrorRate := 0.0
+	othersTimeoutRate := 0.0
+	othersLatency := 0.0
+	latencyOthers := 0
+	for b, o := range stats {
+		if b == backend || o.ejection != nil || o.requests < d.minRequests {
+			continue
+		}
+		others++
+		othersErrorRate += float64(o.errors) / float64(o.requests)
+		othersTimeoutRate += float64(o.timeouts) / float64(o.requests)
+		if o.successes > 0 {
+			latencyOthers++
+			othersLatency += float64(o.latency) / float64(o.successes)
+		}
+	}
+	if others <= 0 {
+		return ""
+	}
+	othersErrorRate /= float64(others)
+	othersTimeoutRate /= float64(others)
+	if errorRate >= d.minRate && errorRate > d.factor*othersErrorRate {
+		return fmt.Sprintf("error rate %.1f%% is higher than average %.1f%%", errorRate*100, othersErrorRate*100)
+	}
+	if timeoutRate >= d.minRate && timeoutRate > d.factor*othersTimeoutRate {
+		return fmt.Sprintf("timeout rate %.1f%% is higher than average %.1f%%", timeoutRate*100, othersTimeoutRate*100)
+	}
+	if s.successes > 0 && latencyOthers > 0 {
+		latency := float64(s.latency) / float64(s.successes)
+		othersLatency /= float64(latencyOthers)
+		if latency > d.latencyFactor*othersLatency {
+			return fmt.Sprintf("latency %s is higher than average %s", time.Duration(latency), time.Duration(othersLatency))
+		}
+	}
+	return ""
+}
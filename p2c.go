@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// P2CEwma implements LoadBalancer interface with power of two choices,
+// two backends are picked randomly and the request is sent to the one
+// with lower latency EWMA x pending requests
+type P2CEwma struct {
+	*backendPool
+}
+
+// NewP2CEwma create a P2CEwma object
+func NewP2CEwma() *P2CEwma {
+	p := &P2CEwma{backendPool: newBackendPool()}
+	p.selector = p.selectBackend
+	return p
+}
+
+// Send send a request to one of thrift backend server
+func (p *P2CEwma) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	p.sendWithFailover(request, requestTimeoutTime, p.selectBackend, make(map[Backend]bool), callback)
+}
+
+func (p *P2CEwma) selectBackend(request *Message, excluded map[Backend]bool) (Backend, error) {
+	backends := p.getSelectableBackends()
+	if len(backends) <= 0 {
+		return nil, noBackendAvailable
+	}
+	candidates := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		if !excluded[backend] {
+			candidates = append(candidates, backend)
+		}
+	}
+	n := len(candidates)
+	switch n {
+	case 0:
+		return nil, failedAllBackends
+	case 1:
+		return candidates[0], nil
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	// a backend without latency sample takes the latency of the other one,
+	// so it is compared by the pending requests
+	defaultLatency := candidates[i].GetLatency()
+	if defaultLatency <= 0 {
+		defaultLatency = candidates[j].GetLatency()
+	}
+	if defaultLatency <= 0 {
+		defaultLatency = time.Millisecond
+	}
+	if p2cScore(candidates[j], defaultLatency) < p2cScore(candidates[i], defaultLatency) {
+		return candidates[j], nil
+	}
+	return candidates[i], nil
+}
+
+// p2cScore the load of backend, the backend with lower score is preferred.
+// The defaultLatency is used if the backend has no latency sample
+func p2cScore(backend Backend, defaultLatency time.Duration) float64 {
+	latency := backend.GetLatency()
+	if latency <= 0 {
+		latency = defaultLatency
+	}
+	return float64(latency) * float64(backend.GetPendingRequests()+1) / backend.GetSlowStartFactor()
+}
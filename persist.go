@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigState the proxies changed or removed at runtime, it is saved in
+// the state file and merged to the configuration at startup
+type ConfigState struct {
+	Proxies        []ProxyConf
+	RemovedProxies []string `yaml:"removedProxies,omitempty"`
+}
+
+// Persister save the changes made through the admin API. The running
+// configuration is written back to the configuration file, or the changed
+// proxies are written to a state file which overrides the proxies with
+// same name in the configuration file. A proxy in the state file is saved
+// in full, so the later changes of it in the configuration file are ignored
+// until it is removed from the state file
+type Persister struct {
+	sync.Mutex
+	fileName string
+	// the fileName is a state file if it is true
+	stateFile bool
+	// the names of proxies changed or removed at runtime, only used for state file
+	changed map[string]bool
+	removed map[string]bool
+	// the hash of the content written to fileName last time
+	lastWritten [sha256.Size]byte
+}
+
+// NewPersister create a Persister writing to fileName, the fileName is
+// the configuration file if stateFile is false
+func NewPersister(fileName string, stateFile bool) *Persister {
+	return &Persister{fileName: fileName,
+		stateFile: stateFile,
+		changed:   make(map[string]bool),
+		removed:   make(map[string]bool)}
+}
+
+// Merge merge the state file to the configuration loaded from configuration file
+func (p *Persister) Merge(config *ProxiesConfigure) error {
+	if !p.stateFile {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	content, err := os.ReadFile(p.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state, err := validateState(p.fileName, content)
+	if err != nil {
+		return err
+	}
+	p.changed = make(map[string]bool)
+	p.removed = make(map[string]bool)
+	for _, name := range state.RemovedProxies {
+		p.removed[name] = true
+	}
+	proxies := make([]ProxyConf, 0)
+	for _, proxyConf := range config.Proxies {
+		if !p.removed[proxyConf.Name] {
+			proxies = append(proxies, proxyConf)
+		}
+	}
+	for _, proxyConf := range state.Proxies {
+		log.WithFields(log.Fields{"file": p.fileName, "proxy": proxyConf.Name}).Warn("The proxy in configuration file is overridden by the state file")
+		p.changed[proxyConf.Name] = true
+		replaced := false
+		for i := range proxies {
+			if proxies[i].Name == proxyConf.Name {
+				proxies[i] = proxyConf
+				replaced = true
+			}
+		}
+		if !replaced {
+			proxies = append(proxies, proxyConf)
+		}
+	}
+	config.Proxies = proxies
+	log.WithFields(log.Fields{"file": p.fileName, "changed": len(state.Proxies), "removed": len(state.RemovedProxies)}).Info("Merge the state file to configuration")
+	return nil
+}
+
+// Save save the running configuration got by getConfig after the proxies are
+// changed or removed, the configuration is got in the lock so the saved
+// configurations are in the order of changes
+func (p *Persister) Save(getConfig func() *ProxiesConfigure, proxies []string, removed bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	config := getConfig()
+	if !p.stateFile {
+		return p.write(config)
+	}
+	for _, name := range proxies {
+		p.changed[name] = !removed
+		p.removed[name] = removed
+	}
+	state := &ConfigState{Proxies: make([]ProxyConf, 0), RemovedProxies: make([]string, 0)}
+	for _, proxyConf := range config.Proxies {
+		if p.changed[proxyConf.Name] {
+			state.Proxies = append(state.Proxies, proxyConf)
+		}
+	}
+	for name, removed := range p.removed {
+		if removed {
+			state.RemovedProxies = append(state.RemovedProxies, name)
+		}
+	}
+	return p.write(state)
+}
+
+func (p *Persister) write(config interface{}) error {
+	content, err := writeConfigFile(p.fileName, config)
+	if err == nil {
+		p.lastWritten = sha256.Sum256(content)
+	}
+	return err
+}
+
+// IsLastWritten check if the content of fileName is written by this persister
+// last time, so the configuration file changed by the persister is not reloaded
+func (p *Persister) IsLastWritten(fileName string, content []byte) bool {
+	p.Lock()
+	defer p.Unlock()
+	return fileName == p.fileName && sha256.Sum256(content) == p.lastWritten
+}
+
+// writeConfigFile write the configuration to a temporary file and rename it to
+// fileName, the previous content of the file is kept in the backup file. The
+// written content is returned
+func writeConfigFile(fileName string, config interface{}) ([]byte, error) {
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode()
+		old, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(fileName+".bak", old, mode); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return nil, err
+	}
+	log.WithFields(log.Fields{"file": fileName}).Info("Write the running configuration")
+	return b, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPersistConfigFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.yaml")
+	writeConfig(t, fileName, "proxies: []\n")
+	config := &ProxiesConfigure{Proxies: []ProxyConf{{Name: "test-1",
+		Listen:   "127.0.0.1:9090",
+		Backends: []BackendInfo{{Addr: "127.0.0.1:10001"}}}}}
+	if err := NewPersister(fileName, false).Save(func() *ProxiesConfigure { return config }, []string{"test-1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(fileName + ".bak"); err != nil || string(b) != "proxies: []\n" {
+		t.Error("The previous configuration should be kept in backup file")
+	}
+	loaded, err := loadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Proxies) != 1 || loaded.Proxies[0].Backends[0].Addr != "127.0.0.1:10001" {
+		t.Errorf("The saved configuration %v is not expected", loaded)
+	}
+}
+
+func TestPersistStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+	running := &ProxiesConfigure{Proxies: []ProxyConf{{Name: "test-1", Listen: "127.0.0.1:9090"},
+		{Name: "test-2", Listen: "127.0.0.1:9091", Backends: []BackendInfo{{Addr: "127.0.0.1:10002"}}},
+		{Name: "test-3", Listen: "127.0.0.1:9092"}}}
+	persister := NewPersister(stateFile, true)
+	if err := persister.Save(func() *ProxiesConfigure { return running }, []string{"test-2"}, false); err != nil {
+		t.Fatal(err)
+	}
+	running.Proxies = running.Proxies[0:2]
+	if err := persister.Save(func() *ProxiesConfigure { return running }, []string{"test-3"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ProxiesConfigure{Proxies: []ProxyConf{{Name: "test-1", Listen: "127.0.0.1:9090"},
+		{Name: "test-2", Listen: "127.0.0.1:9091"},
+		{Name: "test-3", Listen: "127.0.0.1:9092"}}}
+	if err := NewPersister(stateFile, true).Merge(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Proxies) != 2 || config.Proxies[0].Name != "test-1" || config.Proxies[1].Name != "test-2" {
+		t.Fatalf("The merged proxies %v are not expected", config.Proxies)
+	}
+	if len(config.Proxies[1].Backends) != 1 || config.Proxies[1].Backends[0].Addr != "127.0.0.1:10002" {
+		t.Error("The backends in state file should override the configuration")
+	}
+}
+
+func TestMergeInvalidStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+	writeConfig(t, stateFile, "proxies:\n  - name: test-1\n    listen: \"127.0.0.1:9090\"\n    requestTimout: 10s\n")
+	config := &ProxiesConfigure{Proxies: []ProxyConf{{Name: "test-1", Listen: "127.0.0.1:9090"}}}
+	if err := NewPersister(stateFile, true).Merge(config); err == nil {
+		t.Error("The unknown key in state file should be rejected")
+	}
+
+	writeConfig(t, stateFile, "proxies:\n  - name: test-1\n    listen: \"127.0.0.1:9090\"\n    backends:\n      - addr: \"127.0.0.1\"\n")
+	if err := NewPersister(stateFile, true).Merge(config); err == nil || !strings.Contains(err.Error(), "line 5: invalid backend address") {
+		t.Errorf("The invalid proxy in state file should be rejected: %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"math"
 )
 
 type MessageType int
@@ -15,6 +17,7 @@ const (
 )
 
 const (
+	STOP   FieldType = 0
 	BOOL   FieldType = 2
 	BYTE             = 3
 	DOUBLE           = 4
@@ -26,8 +29,93 @@ const (
 	MAP              = 13
 	SET              = 14
 	LIST             = 15
+	UUID             = 16
 )
 
+// ProtocolType the thrift protocol used on a connection
+type ProtocolType int
+
+const (
+	BinaryProtocolType ProtocolType = iota
+	CompactProtocolType
+	// detect the protocol from the first message
+	AutoProtocolType
+)
+
+const (
+	binaryProtocolId  byte = 0x80
+	compactProtocolId byte = 0x82
+)
+
+// parseProtocol parse the protocol from configuration, the
+// binary protocol is used if no protocol is configured
+func parseProtocol(protocol string) (ProtocolType, error) {
+	switch protocol {
+	case "", "binary":
+		return BinaryProtocolType, nil
+	case "compact":
+		return CompactProtocolType, nil
+	case "auto":
+		return AutoProtocolType, nil
+	default:
+		return BinaryProtocolType, fmt.Errorf("Unknown protocol %s", protocol)
+	}
+}
+
+func (p ProtocolType) String() string {
+	switch p {
+	case BinaryProtocolType:
+		return "binary"
+	case CompactProtocolType:
+		return "compact"
+	default:
+		return "auto"
+	}
+}
+
+// ProtocolWriter encode thrift values to a Message
+type ProtocolWriter interface {
+	BeginMessage(name string, msgType MessageType, seqId int)
+	EndMessage()
+	BeginStruct()
+	EndStruct()
+	BeginField(fieldType FieldType, fieldId int)
+	EndField()
+	StopField()
+	BeginMap(keyType FieldType, valueType FieldType, size int)
+	EndMap()
+	BeginList(elemType FieldType, size int)
+	EndList()
+	BeginSet(elemType FieldType, size int)
+	EndSet()
+	WriteBool(value bool)
+	WriteI8(value byte)
+	WriteI16(value int16)
+	WriteInt32(value int)
+	WriteI64(value int64)
+	WriteDouble(value float64)
+	WriteString(s string)
+	WriteBytes(b []byte)
+	WriteUUID(b []byte)
+	ToMessage() *Message
+}
+
+// newProtocolWriter create a ProtocolWriter for the protocol
+func newProtocolWriter(protocol ProtocolType, framed bool) ProtocolWriter {
+	if protocol == CompactProtocolType {
+		return NewCompactProtocol(framed)
+	}
+	return NewBinaryProtocol(framed)
+}
+
+// newProtocolReader create a ProtocolReader for the protocol
+func newProtocolReader(protocol ProtocolType, b []byte, offset int) ProtocolReader {
+	if protocol == CompactProtocolType {
+		return NewCompactProtocolReader(b, offset)
+	}
+	return NewBinaryProtocolReader(b, offset)
+}
+
 type BinaryProtocol struct {
 	framed bool
 	buf    *bytes.Buffer
@@ -35,12 +123,15 @@ type BinaryProtocol struct {
 
 func NewBinaryProtocol(framed bool) *BinaryProtocol {
 	b := &BinaryProtocol{framed: framed, buf: bytes.NewBuffer(make([]byte, 0))}
-	b.WriteInt32(0)
+	// reserve the frame length, it is filled in ToMessage()
+	if framed {
+		b.WriteInt32(0)
+	}
 	return b
 }
 
 func (bp *BinaryProtocol) BeginMessage(name string, msgType MessageType, seqId int) {
-	bp.buf.WriteByte(0x80)
+	bp.buf.WriteByte(binaryProtocolId)
 	bp.buf.WriteByte(0x01)
 	bp.buf.WriteByte(0)
 	bp.buf.WriteByte(byte(msgType))
@@ -52,7 +143,6 @@ func (bp *BinaryProtocol) EndMessage() {
 }
 
 func (bp *BinaryProtocol) BeginStruct() {
-	bp.buf.WriteByte(STRUCT)
 }
 
 func (bp *BinaryProtocol) EndStruct() {
@@ -60,8 +150,7 @@ func (bp *BinaryProtocol) EndStruct() {
 
 func (bp *BinaryProtocol) BeginField(fieldType FieldType, fieldId int) {
 	bp.buf.WriteByte(byte(fieldType))
-	bp.buf.WriteByte(byte((fieldId >> 16) & 0xff))
-	bp.buf.WriteByte(byte(fieldId & 0xff))
+	bp.WriteI16(int16(fieldId))
 }
 
 func (bp *BinaryProtocol) EndField() {
@@ -71,6 +160,47 @@ func (bp *BinaryProtocol) StopField() {
 	bp.buf.WriteByte(0)
 }
 
+func (bp *BinaryProtocol) BeginMap(keyType FieldType, valueType FieldType, size int) {
+	bp.buf.WriteByte(byte(keyType))
+	bp.buf.WriteByte(byte(valueType))
+	bp.WriteInt32(size)
+}
+
+func (bp *BinaryProtocol) EndMap() {
+}
+
+func (bp *BinaryProtocol) BeginList(elemType FieldType, size int) {
+	bp.buf.WriteByte(byte(elemType))
+	bp.WriteInt32(size)
+}
+
+func (bp *BinaryProtocol) EndList() {
+}
+
+func (bp *BinaryProtocol) BeginSet(elemType FieldType, size int) {
+	bp.BeginList(elemType, size)
+}
+
+func (bp *BinaryProtocol) EndSet() {
+}
+
+func (bp *BinaryProtocol) WriteBool(value bool) {
+	if value {
+		bp.buf.WriteByte(1)
+	} else {
+		bp.buf.WriteByte(0)
+	}
+}
+
+func (bp *BinaryProtocol) WriteI8(value byte) {
+	bp.buf.WriteByte(value)
+}
+
+func (bp *BinaryProtocol) WriteI16(value int16) {
+	bp.buf.WriteByte(byte((value >> 8) & 0xff))
+	bp.buf.WriteByte(byte(value & 0xff))
+}
+
 func (bp *BinaryProtocol) WriteInt32(value int) {
 	bp.buf.WriteByte(byte((value >> 24) & 0xff))
 	bp.buf.WriteByte(byte((value >> 16) & 0xff))
@@ -78,6 +208,16 @@ func (bp *BinaryProtocol) WriteInt32(value int) {
 	bp.buf.WriteByte(byte(value & 0xff))
 }
 
+func (bp *BinaryProtocol) WriteI64(value int64) {
+	for i := 56; i >= 0; i -= 8 {
+		bp.buf.WriteByte(byte((value >> i) & 0xff))
+	}
+}
+
+func (bp *BinaryProtocol) WriteDouble(value float64) {
+	bp.WriteI64(int64(math.Float64bits(value)))
+}
+
 func (bp *BinaryProtocol) WriteString(s string) {
 	b := []byte(s)
 	bp.WriteBytes(b)
@@ -88,6 +228,10 @@ func (bp *BinaryProtocol) WriteBytes(b []byte) {
 	bp.buf.Write(b)
 }
 
+func (bp *BinaryProtocol) WriteUUID(b []byte) {
+	bp.buf.Write(b)
+}
+
 func (bp *BinaryProtocol) ToMessage() *Message {
 	b := bp.buf.Bytes()
 	if bp.framed {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+var notEnoughData error = errors.New("not enough data")
+var invalidMessage error = errors.New("invalid thrift message")
+
+// the max nesting depth of struct and container in a message
+const maxNestingDepth = 64
+
+// ProtocolReader read thrift values from a byte buffer
+type ProtocolReader interface {
+	ReadMessageBegin() (name string, msgType MessageType, seqId int, err error)
+	ReadStructBegin() error
+	ReadStructEnd() error
+	ReadFieldBegin() (fieldType FieldType, fieldId int, err error)
+	ReadMapBegin() (keyType FieldType, valueType FieldType, size int, err error)
+	ReadListBegin() (elemType FieldType, size int, err error)
+	ReadSetBegin() (elemType FieldType, size int, err error)
+	ReadBool() (bool, error)
+	ReadByte() (byte, error)
+	ReadI16() (int16, error)
+	ReadI32() (int32, error)
+	ReadI64() (int64, error)
+	ReadDouble() (float64, error)
+	ReadBinary() ([]byte, error)
+	ReadUUID() ([]byte, error)
+
+	// get the offset of next byte to be read
+	Offset() int
+}
+
+// BinaryProtocolReader read values encoded in strict thrift binary protocol
+type BinaryProtocolReader struct {
+	buf    []byte
+	offset int
+}
+
+// NewBinaryProtocolReader create a BinaryProtocolReader reading from offset of b
+func NewBinaryProtocolReader(b []byte, offset int) *BinaryProtocolReader {
+	return &BinaryProtocolReader{buf: b, offset: offset}
+}
+
+func (br *BinaryProtocolReader) next(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, invalidMessage
+	}
+	if br.offset+n > len(br.buf) {
+		return nil, notEnoughData
+	}
+	b := br.buf[br.offset : br.offset+n]
+	br.offset += n
+	return b, nil
+}
+
+func (br *BinaryProtocolReader) Offset() int {
+	return br.offset
+}
+
+func (br *BinaryProtocolReader) ReadMessageBegin() (name string, msgType MessageType, seqId int, err error) {
+	version, err := br.ReadI32()
+	if err != nil {
+		return
+	}
+	if uint32(version)&0xffff0000 != 0x80010000 {
+		err = invalidMessage
+		return
+	}
+	msgType = MessageType(version & 0xff)
+	b, err := br.ReadBinary()
+	if err != nil {
+		return
+	}
+	name = string(b)
+	n, err := br.ReadI32()
+	seqId = int(n)
+	return
+}
+
+func (br *BinaryProtocolReader) ReadStructBegin() error {
+	return nil
+}
+
+func (br *BinaryProtocolReader) ReadStructEnd() error {
+	return nil
+}
+
+func (br *BinaryProtocolReader) ReadFieldBegin() (fieldType FieldType, fieldId int, err error) {
+	t, err := br.ReadByte()
+	if err != nil || FieldType(t) == STOP {
+		return STOP, 0, err
+	}
+	id, err := br.ReadI16()
+	return FieldType(t), int(id), err
+}
+
+func (br *BinaryProtocolReader) ReadMapBegin() (keyType FieldType, valueType FieldType, size int, err error) {
+	b, err := br.next(2)
+	if err != nil {
+		return
+	}
+	n, err := br.ReadI32()
+	if err == nil && n < 0 {
+		err = invalidMessage
+	}
+	return FieldType(b[0]), FieldType(b[1]), int(n), err
+}
+
+func (br *BinaryProtocolReader) ReadListBegin() (elemType FieldType, size int, err error) {
+	t, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	n, err := br.ReadI32()
+	if err == nil && n < 0 {
+		err = invalidMessage
+	}
+	return FieldType(t), int(n), err
+}
+
+func (br *BinaryProtocolReader) ReadSetBegin() (elemType FieldType, size int, err error) {
+	return br.ReadListBegin()
+}
+
+func (br *BinaryProtocolReader) ReadBool() (bool, error) {
+	b, err := br.ReadByte()
+	return b != 0, err
+}
+
+func (br *BinaryProtocolReader) ReadByte() (byte, error) {
+	b, err := br.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (br *BinaryProtocolReader) ReadI16() (int16, error) {
+	b, err := br.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(uint16(b[0])<<8 | uint16(b[1])), nil
+}
+
+func (br *BinaryProtocolReader) ReadI32() (int32, error) {
+	n, err := readInt(br.buf, br.offset)
+	if err != nil {
+		return 0, notEnoughData
+	}
+	br.offset += 4
+	return int32(n), nil
+}
+
+func (br *BinaryProtocolReader) ReadI64() (int64, error) {
+	b, err := br.next(8)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, v := range b {
+		n = n<<8 | uint64(v)
+	}
+	return int64(n), nil
+}
+
+func (br *BinaryProtocolReader) ReadDouble() (float64, error) {
+	n, err := br.ReadI64()
+	return math.Float64frombits(uint64(n)), err
+}
+
+func (br *BinaryProtocolReader) ReadBinary() ([]byte, error) {
+	n, err := br.ReadI32()
+	if err != nil {
+		return nil, err
+	}
+	return br.next(int(n))
+}
+
+func (br *BinaryProtocolReader) ReadUUID() ([]byte, error) {
+	return br.next(16)
+}
+
+// skipMessage skip a whole thrift message including its arguments or result struct
+func skipMessage(reader ProtocolReader) error {
+	_, _, _, err := reader.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	return skipStruct(reader, 0)
+}
+
+func skipStruct(reader ProtocolReader, depth int) error {
+	if depth > maxNestingDepth {
+		return invalidMessage
+	}
+	err := reader.ReadStructBegin()
+	if err != nil {
+		return err
+	}
+	for {
+		fieldType, _, err := reader.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if fieldType == STOP {
+			break
+		}
+		err = skipValue(reader, fieldType, depth)
+		if err != nil {
+			return err
+		}
+	}
+	return reader.ReadStructEnd()
+}
+
+// skipValue skip a value with type fieldType
+func skipValue(reader ProtocolReader, fieldType FieldType, depth int) error {
+	if depth > maxNestingDepth {
+		return invalidMessage
+	}
+	var err error
+	switch fieldType {
+	case BOOL:
+		_, err = reader.ReadBool()
+	case BYTE:
+		_, err = reader.ReadByte()
+	case I16:
+		_, err = reader.ReadI16()
+	case I32:
+		_, err = reader.ReadI32()
+	case I64:
+		_, err = reader.ReadI64()
+	case DOUBLE:
+		_, err = reader.ReadDouble()
+	case STRING:
+		_, err = reader.ReadBinary()
+	case UUID:
+		_, err = reader.ReadUUID()
+	case STRUCT:
+		err = skipStruct(reader, depth+1)
+	case MAP:
+		var keyType, valueType FieldType
+		var size int
+		keyType, valueType, size, err = reader.ReadMapBegin()
+		for i := 0; err == nil && i < size; i++ {
+			err = skipValue(reader, keyType, depth+1)
+			if err == nil {
+				err = skipValue(reader, valueType, depth+1)
+			}
+		}
+	case SET, LIST:
+		var elemType FieldType
+		var size int
+		if fieldType == SET {
+			elemType, size, err = reader.ReadSetBegin()
+		} else {
+			elemType, size, err = reader.ReadListBegin()
+		}
+		for i := 0; err == nil && i < size; i++ {
+			err = skipValue(reader, elemType, depth+1)
+		}
+	default:
+		err = invalidMessage
+	}
+	return err
+}
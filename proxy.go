@@ -2,137 +2,556 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var noSuchProxy error = errors.New("Fail to find proxy")
+
 type ProxyMgr struct {
+	sync.Mutex
 	proxies []*Proxy
+	// the proxies are started when they are added after Run
+	running bool
+	wg      sync.WaitGroup
 }
 
 func NewProxyMgr() *ProxyMgr {
-	return &ProxyMgr{proxies: make([]*Proxy, 0)}
+	return &ProxyMgr{proxies: make([]*Proxy, 0), running: false}
+}
+
+// AddProxy add a proxy, the proxy is started if the ProxyMgr is running
+func (p *ProxyMgr) AddProxy(proxy *Proxy) error {
+	p.Lock()
+	defer p.Unlock()
+	for _, t := range p.proxies {
+		if t.name == proxy.name {
+			return fmt.Errorf("Proxy %s already exists", proxy.name)
+		}
+	}
+	p.addProxy(proxy)
+	return nil
 }
 
-func (p *ProxyMgr) AddProxy(proxy *Proxy) {
+func (p *ProxyMgr) addProxy(proxy *Proxy) {
 	p.proxies = append(p.proxies, proxy)
+	if p.running {
+		p.wg.Add(1)
+		go p.startProxy(proxy)
+	}
+}
+
+// ReplaceProxy replace the proxy with same name and shutdown the replaced
+// proxy in background, return false if no proxy is replaced. The new proxy
+// listens before it is added, if it fails to listen, it is shutdown and the
+// replaced proxy keeps accepting connections
+func (p *ProxyMgr) ReplaceProxy(proxy *Proxy, shutdownTimeout time.Duration) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	for index, old := range p.proxies {
+		if old.name == proxy.name {
+			// the listener is closed before listening on the same address
+			old.StopAccept()
+			if err := proxy.Listen(); err != nil {
+				proxy.Shutdown(0)
+				if resumeErr := old.resumeAccept(); resumeErr != nil {
+					log.WithFields(log.Fields{"name": old.name, "error": resumeErr}).Error("Fail to resume accepting connections")
+					p.proxies = append(p.proxies[0:index], p.proxies[index+1:]...)
+					go old.Shutdown(shutdownTimeout)
+				} else if p.running {
+					p.wg.Add(1)
+					go p.startProxy(old)
+				}
+				return true, err
+			}
+			p.proxies = append(p.proxies[0:index], p.proxies[index+1:]...)
+			go old.Shutdown(shutdownTimeout)
+			p.addProxy(proxy)
+			return true, nil
+		}
+	}
+	if err := proxy.Listen(); err != nil {
+		proxy.Shutdown(0)
+		return false, err
+	}
+	p.addProxy(proxy)
+	return false, nil
 }
 
-func (p *ProxyMgr) RemoveProxy(name string) {
+// CreateProxy create a proxy from configuration, listen on its address and add it
+func (p *ProxyMgr) CreateProxy(proxyConf *ProxyConf) error {
+	if len(proxyConf.Name) <= 0 {
+		return errors.New("The name of proxy is not configured")
+	}
+	if _, err := p.GetProxy(proxyConf.Name); err == nil {
+		return fmt.Errorf("Proxy %s already exists", proxyConf.Name)
+	}
+	proxy, err := createProxy(proxyConf)
+	if err != nil {
+		return err
+	}
+	err = proxy.Listen()
+	if err == nil {
+		err = p.AddProxy(proxy)
+	}
+	if err != nil {
+		proxy.Shutdown(0)
+	}
+	return err
+}
+
+// UpdateProxy update the proxy by configuration. The backends and request timeout
+// are updated in place, and the proxy is restarted if its other settings are changed
+func (p *ProxyMgr) UpdateProxy(proxyConf *ProxyConf, shutdownTimeout time.Duration) ([]string, error) {
+	old, err := p.GetProxy(proxyConf.Name)
+	if err != nil {
+		return nil, err
+	}
+	if oldConf := old.getConf(); oldConf != nil && !isProxyConfChanged(oldConf, proxyConf) {
+		return updateProxy(old, proxyConf), nil
+	}
+	proxy, err := createProxy(proxyConf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.ReplaceProxy(proxy, shutdownTimeout); err != nil {
+		return nil, fmt.Errorf("Fail to restart proxy %s: %v", proxyConf.Name, err)
+	}
+	return []string{fmt.Sprintf("Restart proxy %s", proxyConf.Name)}, nil
+}
+
+// DeleteProxy remove the proxy and shutdown it in background, the listener
+// is closed before return
+func (p *ProxyMgr) DeleteProxy(name string, shutdownTimeout time.Duration) error {
+	proxy, err := p.RemoveProxy(name)
+	if err != nil {
+		return err
+	}
+	proxy.StopAccept()
+	go proxy.Shutdown(shutdownTimeout)
+	return nil
+}
+
+// RemoveProxy remove the proxy by name, the removed proxy is not stopped
+func (p *ProxyMgr) RemoveProxy(name string) (*Proxy, error) {
+	p.Lock()
+	defer p.Unlock()
 	for index, proxy := range p.proxies {
 		if proxy.name == name {
 			p.proxies = append(p.proxies[0:index], p.proxies[index+1:]...)
+			return proxy, nil
 		}
 	}
+	return nil, noSuchProxy
 }
 
 func (p *ProxyMgr) GetProxy(name string) (*Proxy, error) {
+	p.Lock()
+	defer p.Unlock()
 	for _, proxy := range p.proxies {
 		if proxy.name == name {
 			return proxy, nil
 		}
 	}
-	return nil, errors.New("Fail to find proxy")
+	return nil, noSuchProxy
 }
 
 func (p *ProxyMgr) GetAllProxy() []*Proxy {
+	p.Lock()
+	defer p.Unlock()
 	r := make([]*Proxy, 0)
 	r = append(r, p.proxies...)
 	return r
 }
 
-// Start start all the proxies
+// Run start all the proxies and wait until the ProxyMgr is shutdown and
+// the proxies are stopped
 func (p *ProxyMgr) Run() {
-	var wg sync.WaitGroup
+	p.Lock()
+	p.running = true
+	// the count of ProxyMgr itself, it is done in Shutdown
+	p.wg.Add(1)
 	for _, proxy := range p.proxies {
-		wg.Add(1)
-		go p.startProxy(proxy, &wg)
+		p.wg.Add(1)
+		go p.startProxy(proxy)
 	}
+	p.Unlock()
 
-	wg.Wait()
+	p.wg.Wait()
 }
 
-func (p *ProxyMgr) startProxy(proxy *Proxy, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (p *ProxyMgr) startProxy(proxy *Proxy) {
+	defer p.wg.Done()
 	proxy.Run()
 }
 
+// Shutdown shutdown all the proxies gracefully, return false if any
+// proxy fails to finish its pending requests in timeout
+func (p *ProxyMgr) Shutdown(timeout time.Duration) bool {
+	var wg sync.WaitGroup
+	var failed int32 = 0
+	for _, proxy := range p.GetAllProxy() {
+		wg.Add(1)
+		go func(proxy *Proxy) {
+			defer wg.Done()
+			if !proxy.Shutdown(timeout) {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(proxy)
+	}
+	wg.Wait()
+	p.Lock()
+	if p.running {
+		p.running = false
+		p.wg.Done()
+	}
+	p.Unlock()
+	return failed == 0
+}
+
 type Proxy struct {
 	name           string
 	addr           string
+	codec          *Codec
+	maxMessageSize int
 	requestTimeout time.Duration
 	seqIdAllocator *SeqIdAllocator
-	loadBalancer   LoadBalancer
+	router         *Router
+	backendCodec   *Codec
+	affinity       bool
 	clients        []*Client
 	clientLock     sync.Mutex
+	listener       net.Listener
+	stopped        int32
+	shutdown       int32
+	// the configuration of proxy, nil if it is not created from configuration
+	conf *ProxyConf
 }
 
 // NewProxy create a thrift proxy listening on the addr
-// and all received message will be forward by loadBalancer
-// to backend thrift servers
+// and all received message will be forward by router
+// to backend thrift servers. The messages are translated to
+// backendCodec if it is not nil. If affinity is true, the
+// requests from a client connection are sent to the same backend
 func NewProxy(name string,
 	addr string,
+	codec *Codec,
+	backendCodec *Codec,
 	requestTimeout time.Duration,
-	loadBalancer LoadBalancer) *Proxy {
+	router *Router,
+	affinity bool) (*Proxy, error) {
+	if backendCodec != nil {
+		if _, err := NewTranslator(backendCodec, router); err != nil {
+			return nil, err
+		}
+	}
 	proxy := &Proxy{name: name,
 		addr:           addr,
+		codec:          codec,
+		maxMessageSize: defaultMaxMessageSize,
 		requestTimeout: requestTimeout,
 		seqIdAllocator: NewSeqIdAllocator(),
-		loadBalancer:   loadBalancer,
-		clients:        make([]*Client, 0)}
+		router:         router,
+		backendCodec:   backendCodec,
+		affinity:       affinity,
+		clients:        make([]*Client, 0),
+		listener:       nil,
+		stopped:        0,
+		shutdown:       0,
+		conf:           nil}
 
-	return proxy
+	return proxy, nil
+}
+
+// createSender create the sender for the requests of a client connection
+func (p *Proxy) createSender(clientAddr string) Sender {
+	var sender Sender = p.router
+	if p.affinity {
+		sender = newAffinitySender(p.router, NewAffinity(clientAddr))
+	}
+	if p.backendCodec != nil {
+		// the backendCodec is checked when creating the proxy
+		translator, _ := NewTranslator(p.backendCodec, sender)
+		sender = translator
+	}
+	return sender
+}
+
+// Listen listen on the address of proxy if it is not listened
+func (p *Proxy) Listen() error {
+	if p.getListener() != nil {
+		return nil
+	}
+	ln, err := listen(p.addr)
+	if err != nil {
+		log.WithFields(log.Fields{"address": p.addr, "error": err}).Error("Fail to listen on address")
+		return err
+	}
+	if !p.setListener(ln) {
+		return errors.New("Proxy is stopped")
+	}
+	log.WithFields(log.Fields{"address": p.addr}).Info("Listen on address")
+	return nil
 }
 
 func (p *Proxy) Run() {
 	log.WithFields(log.Fields{"name": p.name}).Info("Start proxy")
-	ln, err := net.Listen("tcp", p.addr)
-	if err != nil {
-		log.WithFields(log.Fields{"address": p.addr}).Error("Fail to listen on address")
+	if p.Listen() != nil {
 		return
 	}
-
-	log.WithFields(log.Fields{"address": p.addr}).Info("Listen on address")
+	ln := p.getListener()
 
 	for {
 		conn, err := ln.Accept()
+		// the listener is replaced if the accepting is resumed
+		if err != nil && (p.isStopped() || p.getListener() != ln) {
+			log.WithFields(log.Fields{"name": p.name}).Info("Stop accepting connections")
+			return
+		}
 		if err == nil {
 			client := NewClient(conn,
-				p.requestTimeout,
+				p.codec,
+				p.getMaxMessageSize(),
+				p.getRequestTimeout(),
 				p.seqIdAllocator,
-				p.loadBalancer,
+				p.createSender(conn.RemoteAddr().String()),
 				p.removeClient)
 
 			log.WithFields(log.Fields{"address": conn.RemoteAddr().String()}).Info("Accept connection")
-			p.addClient(client)
+			if !p.addClient(client) {
+				client.StopRead()
+				client.Close()
+			}
 		}
 	}
 }
 
+// setListener set the listener of the proxy, the listener is
+// closed if the proxy is stopped
+func (p *Proxy) setListener(ln net.Listener) bool {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	if p.isStopped() {
+		ln.Close()
+		return false
+	}
+	p.listener = ln
+	return true
+}
+
+// StopAccept close the listener and stop accepting connections
+func (p *Proxy) StopAccept() {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	atomic.StoreInt32(&p.stopped, 1)
+	if p.listener != nil {
+		p.listener.Close()
+	}
+}
+
+// resumeAccept listen on the address again after StopAccept, it fails if
+// the proxy is shutdown
+func (p *Proxy) resumeAccept() error {
+	p.clientLock.Lock()
+	if atomic.LoadInt32(&p.shutdown) != 0 {
+		p.clientLock.Unlock()
+		return errors.New("Proxy is shutdown")
+	}
+	atomic.StoreInt32(&p.stopped, 0)
+	p.listener = nil
+	p.clientLock.Unlock()
+	return p.Listen()
+}
+
+func (p *Proxy) getListener() net.Listener {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	return p.listener
+}
+
+func (p *Proxy) isStopped() bool {
+	return atomic.LoadInt32(&p.stopped) != 0
+}
+
+// Shutdown stop accepting connections and reading requests from the clients,
+// the client connections are closed after the pending requests are responded
+// or timeout. Return false if the pending requests are not finished in timeout
+func (p *Proxy) Shutdown(timeout time.Duration) bool {
+	if !atomic.CompareAndSwapInt32(&p.shutdown, 0, 1) {
+		return true
+	}
+	log.WithFields(log.Fields{"name": p.name}).Info("Shutdown proxy")
+	deadline := time.Now().Add(timeout)
+	p.StopAccept()
+
+	clients := p.getClients()
+	for _, client := range clients {
+		client.StopRead()
+	}
+	pending := p.getPendingRequests(clients)
+	for pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+		pending = p.getPendingRequests(clients)
+	}
+	if pending > 0 {
+		log.WithFields(log.Fields{"name": p.name, "pending": pending}).Error("Timeout to finish the pending requests")
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+	for _, client := range clients {
+		client.waitClosed(deadline)
+	}
+	for _, route := range p.GetAllRoutes() {
+		route.GetLoadBalancer().Stop()
+	}
+	log.WithFields(log.Fields{"name": p.name}).Info("Proxy is shutdown")
+	return pending == 0
+}
+
+func (p *Proxy) getPendingRequests(clients []*Client) int {
+	n := 0
+	for _, client := range clients {
+		n += client.GetPendingRequests()
+	}
+	return n
+}
+
+func (p *Proxy) getConf() *ProxyConf {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	return p.conf
+}
+
+func (p *Proxy) setConf(proxyConf *ProxyConf) {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	conf := *proxyConf
+	p.conf = &conf
+}
+
+// GetConf get the running configuration of the proxy with the backends
+// added or removed at runtime, nil if it is not created from configuration
+func (p *Proxy) GetConf() *ProxyConf {
+	conf := p.getConf()
+	if conf == nil {
+		return nil
+	}
+	result := *conf
+	result.Backends = p.getBackendInfos("")
+	result.Routes = make([]RouteConf, 0, len(conf.Routes))
+	for _, routeConf := range conf.Routes {
+		routeConf.Backends = p.getBackendInfos(getRouteName(&routeConf))
+		result.Routes = append(result.Routes, routeConf)
+	}
+	return &result
+}
+
+// getBackendInfos get the backends of the route
+func (p *Proxy) getBackendInfos(route string) []BackendInfo {
+	r, err := p.router.GetRoute(route)
+	if err != nil {
+		return make([]BackendInfo, 0)
+	}
+	return r.GetLoadBalancer().GetBackendInfos()
+}
+
+func (p *Proxy) getRequestTimeout() time.Duration {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	return p.requestTimeout
+}
+
+// SetRequestTimeout change the request timeout of the proxy and its clients
+// SetMaxMessageSize set the max size of the requests from the clients
+// accepted after it, no limit if it is not greater than 0
+func (p *Proxy) SetMaxMessageSize(maxMessageSize int) {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	p.maxMessageSize = maxMessageSize
+}
+
+func (p *Proxy) getMaxMessageSize() int {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	return p.maxMessageSize
+}
+
+func (p *Proxy) SetRequestTimeout(requestTimeout time.Duration) {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	p.requestTimeout = requestTimeout
+	for _, client := range p.clients {
+		client.SetRequestTimeout(requestTimeout)
+	}
+}
+
 func (p *Proxy) GetName() string {
 	return p.name
 }
-func (p *Proxy) AddBackend(backendInfo *BackendInfo) {
-	p.loadBalancer.AddBackend(backendInfo)
+
+// AddBackend add a backend to the route, the empty route is the default route
+func (p *Proxy) AddBackend(route string, backendInfo *BackendInfo) error {
+	r, err := p.router.GetRoute(route)
+	if err == nil {
+		r.GetLoadBalancer().AddBackend(backendInfo)
+	}
+	return err
 }
 
-func (p *Proxy) RemoveBackend(addr string) {
-	p.loadBalancer.RemoveBackend(addr)
+// RemoveBackend remove a backend from the route
+func (p *Proxy) RemoveBackend(route string, addr string) error {
+	r, err := p.router.GetRoute(route)
+	if err == nil {
+		err = r.GetLoadBalancer().RemoveBackend(addr)
+	}
+	return err
 }
 
+// DrainBackend drain a backend of the route without removing it
+func (p *Proxy) DrainBackend(route string, addr string) error {
+	r, err := p.router.GetRoute(route)
+	if err == nil {
+		err = r.GetLoadBalancer().DrainBackend(addr)
+	}
+	return err
+}
+
+// GetAllBackends get the backends of default route
 func (p *Proxy) GetAllBackends() []Backend {
-	return p.loadBalancer.GetAllBackends()
+	r, _ := p.router.GetRoute("")
+	return r.GetLoadBalancer().GetAllBackends()
+}
+
+// GetAllRoutes get all the routes including the default route
+func (p *Proxy) GetAllRoutes() []*Route {
+	return p.router.GetAllRoutes()
 }
 
-func (p *Proxy) addClient(client *Client) {
+// addClient add the client if the proxy is not stopped
+func (p *Proxy) addClient(client *Client) bool {
 	p.clientLock.Lock()
 	defer p.clientLock.Unlock()
+	if p.isStopped() {
+		return false
+	}
 	p.clients = append(p.clients, client)
+	return true
 
 }
 
+func (p *Proxy) getClients() []*Client {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	result := make([]*Client, len(p.clients))
+	copy(result, p.clients)
+	return result
+}
+
 func (p *Proxy) removeClient(c *Client) {
 	p.clientLock.Lock()
 	defer p.clientLock.Unlock()
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestProxy start a proxy forwarding the requests to backendAddr
+func startTestProxy(t *testing.T, backendAddr string) *Proxy {
+	loadBalancer := NewRoundrobin()
+	loadBalancer.AddBackend(&BackendInfo{Addr: backendAddr})
+	proxy, err := NewProxy("test",
+		"127.0.0.1:0",
+		NewCodec(BinaryProtocolType, FramedTransport),
+		nil,
+		time.Second,
+		NewRouter(loadBalancer),
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	for i := 0; i < 100 && proxy.getListenAddr() == ""; i++ {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	if !waitConnected(loadBalancer.GetAllBackends()[0]) {
+		t.Fatal("Fail to connect to the backend")
+	}
+	return proxy
+}
+
+func (p *Proxy) getListenAddr() string {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	if p.listener == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
+
+func TestProxyShutdown(t *testing.T) {
+	ln := startEchoServer(t, time.Duration(100)*time.Millisecond)
+	defer ln.Close()
+	proxy := startTestProxy(t, ln.Addr().String())
+	addr := proxy.getListenAddr()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := createInternalErrorException(BinaryProtocolType, true, "test", 7, "")
+	if err := msg.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the request is received by the proxy
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	result := make(chan bool, 1)
+	go func() {
+		result <- proxy.Shutdown(time.Second)
+	}()
+
+	buffer := make([]byte, 4096)
+	msgBuffer := NewMessageBuffer(FramedTransport, BinaryProtocolType)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal("The pending request should be responded before shutdown")
+		}
+		msgBuffer.Add(buffer[0:n])
+		if response, err := msgBuffer.ExtractMessage(); err == nil {
+			if seqId, _ := response.GetSeqId(); seqId != 7 {
+				t.Errorf("The seqId %d of response is not expected", seqId)
+			}
+			break
+		}
+	}
+	if !<-result {
+		t.Error("The proxy should be shutdown cleanly")
+	}
+	if _, err := conn.Read(buffer); err == nil {
+		t.Error("The client connection should be closed")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("The proxy should stop accepting connections")
+	}
+}
+
+func TestProxyRejectMalformedRequest(t *testing.T) {
+	ln := startEchoServer(t, 0)
+	defer ln.Close()
+	proxy := startTestProxy(t, ln.Addr().String())
+	defer proxy.Shutdown(0)
+
+	conn, err := net.Dial("tcp", proxy.getListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 0, 0, 0x0c, 0x80, 1, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 4096)); err == nil || isTimeout(err) {
+		t.Fatalf("The connection with malformed request should be closed, but %v", err)
+	}
+
+	// the proxy keeps serving other clients
+	conn, err = net.Dial("tcp", proxy.getListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	createInternalErrorException(BinaryProtocolType, true, "test", 3, "").Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 4096)); err != nil || n <= 0 {
+		t.Errorf("The request should be responded, but %v", err)
+	}
+}
+
+func TestClientPendingRequests(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(conn, NewCodec(BinaryProtocolType, FramedTransport), defaultMaxMessageSize, time.Second, NewSeqIdAllocator(), newRecordLoadBalancer(), func(*Client) {})
+	defer client.Close()
+
+	// the response without mapped seqId is dropped and the request is not pending
+	atomic.AddInt32(&client.pendingRequests, 1)
+	client.processResponse("test", 100, BinaryProtocolType, true, nil, notConnectedError)
+	if n := client.GetPendingRequests(); n != 0 {
+		t.Errorf("The pending requests should be 0, but %d", n)
+	}
+
+	// the error is replied if the seqId of request can't be replaced
+	go client.processRequest(NewMessage([]byte{0, 0, 0, 0x0a, 0x80, 1, 0, 1, 0, 0, 0, 2, 'a', 'b'}))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 4096)
+	n, err := peer.Read(b)
+	if err != nil {
+		t.Fatalf("The error should be replied, but %v", err)
+	}
+	if msg := NewMessage(b[0:n]); msg.GetType() != int(Exception) {
+		t.Errorf("The reply %d should be an exception", msg.GetType())
+	}
+}
+
+func postAdmin(admin *Admin, path string, body string) int {
+	recorder := httptest.NewRecorder()
+	admin.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return recorder.Code
+}
+
+func TestAdminProxies(t *testing.T) {
+	proxyMgr := NewProxyMgr()
+	go proxyMgr.Run()
+	defer proxyMgr.Shutdown(0)
+	admin := NewAdmin("", proxyMgr, NewReloader("", &ProxiesConfigure{}, proxyMgr))
+
+	body := `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    backends:
+      - addr: "127.0.0.1:10001"
+`
+	if postAdmin(admin, "/proxies/add", body) != http.StatusOK {
+		t.Fatal("Fail to add proxy")
+	}
+	proxy, err := proxyMgr.GetProxy("test-1")
+	if err != nil || proxy.getListenAddr() == "" {
+		t.Fatal("The added proxy should be started")
+	}
+	if postAdmin(admin, "/proxies/add", body) != http.StatusBadRequest {
+		t.Error("The duplicate proxy should be rejected")
+	}
+	invalid := `
+proxies:
+  - name: test-2
+    listen: "127.0.0.1:0"
+    requestTimeout: 5
+    backends:
+      - addr: "127.0.0.1:10001"
+        readiness:
+          protocol: udp
+`
+	if postAdmin(admin, "/proxies/add", invalid) != http.StatusBadRequest {
+		t.Error("The invalid proxy should be rejected")
+	}
+	if _, err := proxyMgr.GetProxy("test-2"); err == nil {
+		t.Error("The invalid proxy should not be added")
+	}
+
+	body = `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    requestTimeout: 5s
+    backends:
+      - addr: "127.0.0.1:10002"
+`
+	if postAdmin(admin, "/proxies/update", body) != http.StatusOK {
+		t.Fatal("Fail to update proxy")
+	}
+	if p, _ := proxyMgr.GetProxy("test-1"); p != proxy || proxy.getRequestTimeout() != time.Duration(5)*time.Second {
+		t.Error("The proxy should be updated in place")
+	}
+
+	// the proxy keeps running if the restarted proxy fails to listen
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	body = `
+proxies:
+  - name: test-1
+    listen: "` + used.Addr().String() + `"
+    backends:
+      - addr: "127.0.0.1:10002"
+`
+	if postAdmin(admin, "/proxies/update", body) != http.StatusBadRequest {
+		t.Error("The proxy failing to listen should be rejected")
+	}
+	if p, _ := proxyMgr.GetProxy("test-1"); p != proxy || proxy.getListenAddr() == "" {
+		t.Fatal("The proxy should keep running")
+	}
+	addr := proxy.getListenAddr()
+	if c, err := net.Dial("tcp", addr); err != nil {
+		t.Error("The proxy should keep accepting connections")
+	} else {
+		c.Close()
+	}
+
+	if postAdmin(admin, "/proxies/remove", "proxies:\n  - name: test-1\n") != http.StatusOK {
+		t.Fatal("Fail to remove proxy")
+	}
+	if _, err := proxyMgr.GetProxy("test-1"); err == nil {
+		t.Error("The proxy should be removed")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("The listener of removed proxy should be closed")
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"net/http"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type ReadinessCreator = func(addr string, readinessConf *ReadinessConf) Readiness
@@ -24,15 +31,16 @@ func (n *NullReadiness) IsReady() bool {
 }
 
 type TcpReadiness struct {
-	addr string
+	addr    string
+	timeout time.Duration
 }
 
-func NewTcpReadiness(addr string) *TcpReadiness {
-	return &TcpReadiness{addr: addr}
+func NewTcpReadiness(addr string, timeout time.Duration) *TcpReadiness {
+	return &TcpReadiness{addr: addr, timeout: timeout}
 }
 
 func (t *TcpReadiness) IsReady() bool {
-	conn, err := net.Dial("tcp", t.addr)
+	conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
 	if err != nil {
 		return false
 	}
@@ -40,21 +48,163 @@ func (t *TcpReadiness) IsReady() bool {
 	return true
 }
 
+// HttpReadiness the server is ready if the url returns an expected status
+// code and the body contains the expected string
 type HttpReadiness struct {
-	url string
+	url            string
+	client         *http.Client
+	headers        map[string]string
+	expectedStatus []int
+	bodyContains   string
 }
 
-func NewHttpReadiness(url string) *HttpReadiness {
-	return &HttpReadiness{url: url}
+// NewHttpReadiness create a HttpReadiness, the status codes 2xx and 3xx are
+// expected if expectedStatus is empty
+func NewHttpReadiness(url string, client *http.Client, readinessConf *ReadinessConf) *HttpReadiness {
+	return &HttpReadiness{url: url,
+		client:         client,
+		headers:        readinessConf.Headers,
+		expectedStatus: readinessConf.ExpectedStatus,
+		bodyContains:   readinessConf.BodyContains}
 }
 
 func (h *HttpReadiness) IsReady() bool {
-	resp, err := http.Get(h.url)
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return false
+	}
+	for name, value := range h.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := h.client.Do(req)
 	if err != nil {
 		return false
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode >= 200 && resp.StatusCode < 400
+	if !h.isExpectedStatus(resp.StatusCode) {
+		return false
+	}
+	if len(h.bodyContains) > 0 {
+		body, err := io.ReadAll(resp.Body)
+		return err == nil && strings.Contains(string(body), h.bodyContains)
+	}
+	return true
+}
+
+func (h *HttpReadiness) isExpectedStatus(statusCode int) bool {
+	if len(h.expectedStatus) <= 0 {
+		return statusCode >= 200 && statusCode < 400
+	}
+	for _, code := range h.expectedStatus {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecReadiness the server is ready if the command exits with code 0
+type ExecReadiness struct {
+	command []string
+	timeout time.Duration
+}
+
+func NewExecReadiness(command []string, timeout time.Duration) *ExecReadiness {
+	return &ExecReadiness{command: command, timeout: timeout}
+}
+
+func (e *ExecReadiness) IsReady() bool {
+	if len(e.command) <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	err := exec.CommandContext(ctx, e.command[0], e.command[1:]...).Run()
+	if err != nil {
+		log.WithFields(log.Fields{"command": strings.Join(e.command, " "), "error": err}).Debug("Readiness command is failed")
+		return false
+	}
+	return true
+}
+
+// failedReadiness is never ready, it is used if the readiness is misconfigured
+type failedReadiness struct {
+}
 
+func (f *failedReadiness) IsReady() bool {
+	return false
+}
+
+// ReadinessProber run the readiness probe periodically in the whole lifetime
+// of backend. It becomes ready after successThreshold consecutive successes
+// and not ready after failureThreshold consecutive failures
+type ReadinessProber struct {
+	addr             string
+	readiness        Readiness
+	interval         time.Duration
+	successThreshold int
+	failureThreshold int
+	ready            int32
+	successes        int
+	failures         int
+	stop             int32
+}
+
+// NewReadinessProber create a ReadinessProber to run readiness periodically
+func NewReadinessProber(addr string, readiness Readiness, readinessConf *ReadinessConf) *ReadinessProber {
+	p := &ReadinessProber{addr: addr,
+		readiness:        readiness,
+		interval:         convertDuration(readinessConf.Interval, time.Duration(10)*time.Second),
+		successThreshold: readinessConf.SuccessThreshold,
+		failureThreshold: readinessConf.FailureThreshold,
+		ready:            0}
+	if p.successThreshold <= 0 {
+		p.successThreshold = 1
+	}
+	if p.failureThreshold <= 0 {
+		p.failureThreshold = 3
+	}
+	return p
+}
+
+// Start start probing in background
+func (p *ReadinessProber) Start() {
+	go func() {
+		for atomic.LoadInt32(&p.stop) == 0 {
+			p.probe()
+			time.Sleep(p.interval)
+		}
+	}()
+}
+
+// Stop stop probing
+func (p *ReadinessProber) Stop() {
+	atomic.StoreInt32(&p.stop, 1)
+}
+
+// IsReady get the result of the recent probes
+func (p *ReadinessProber) IsReady() bool {
+	return atomic.LoadInt32(&p.ready) != 0
+}
+
+func (p *ReadinessProber) probe() {
+	if p.readiness.IsReady() {
+		p.successes++
+		p.failures = 0
+		if p.successes >= p.successThreshold && atomic.CompareAndSwapInt32(&p.ready, 0, 1) {
+			log.WithFields(log.Fields{"address": p.addr}).Info("Server is ready")
+		}
+	} else {
+		p.failures++
+		p.successes = 0
+		// the server is not ready before the first success
+		if p.failures >= p.failureThreshold && atomic.CompareAndSwapInt32(&p.ready, 1, 0) {
+			log.WithFields(log.Fields{"address": p.addr}).Error("Server becomes not ready")
+		}
+	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type switchReadiness struct {
+	ready int32
+}
+
+func (s *switchReadiness) IsReady() bool {
+	return atomic.LoadInt32(&s.ready) != 0
+}
+
+func TestReadinessProber(t *testing.T) {
+	readiness := &switchReadiness{ready: 0}
+	prober := NewReadinessProber("127.0.0.1:1", readiness, &ReadinessConf{Interval: "10ms", SuccessThreshold: 2, FailureThreshold: 3})
+	prober.Start()
+	defer prober.Stop()
+
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	if prober.IsReady() {
+		t.Fatal("The server should not be ready before the probe succeeds")
+	}
+	atomic.StoreInt32(&readiness.ready, 1)
+	if !waitFor(time.Second, prober.IsReady) {
+		t.Fatal("The server should be ready")
+	}
+	atomic.StoreInt32(&readiness.ready, 0)
+	if !waitFor(time.Second, func() bool { return !prober.IsReady() }) {
+		t.Fatal("The server should become not ready")
+	}
+}
+
+func TestExecReadiness(t *testing.T) {
+	if !NewExecReadiness([]string{"sh", "-c", "exit 0"}, time.Second).IsReady() {
+		t.Error("The command exits with 0 should be ready")
+	}
+	if NewExecReadiness([]string{"sh", "-c", "exit 1"}, time.Second).IsReady() {
+		t.Error("The command exits with 1 should not be ready")
+	}
+	if NewExecReadiness([]string{"sleep", "1"}, time.Duration(50)*time.Millisecond).IsReady() {
+		t.Error("The command is timeout should not be ready")
+	}
+}
+
+func TestHttpReadiness(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Probe") != "thriftproxy" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("status: serving"))
+	}))
+	defer server.Close()
+
+	conf := &ReadinessConf{Headers: map[string]string{"X-Probe": "thriftproxy"},
+		ExpectedStatus: []int{http.StatusAccepted},
+		BodyContains:   "serving"}
+	if !NewHttpReadiness(server.URL, server.Client(), conf).IsReady() {
+		t.Error("The server should be ready")
+	}
+	conf.BodyContains = "stopped"
+	if NewHttpReadiness(server.URL, server.Client(), conf).IsReady() {
+		t.Error("The body does not contain the expected string")
+	}
+	if NewHttpReadiness(server.URL, server.Client(), &ReadinessConf{}).IsReady() {
+		t.Error("The status 403 should not be ready")
+	}
+}
+
+func TestGrpcReadiness(t *testing.T) {
+	var serving int32 = 1
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.ReadAll(r.Body)
+		status := byte(2)
+		if atomic.LoadInt32(&serving) != 0 {
+			status = 1
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	client, err := createHttpClient(&ReadinessConf{Protocol: "grpc"}, true, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readiness := NewGrpcReadiness(server.URL, "", client)
+	if !readiness.IsReady() {
+		t.Fatal("The grpc server should be ready")
+	}
+	atomic.StoreInt32(&serving, 0)
+	if readiness.IsReady() {
+		t.Fatal("The grpc server is not serving")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the interval to check if the configuration file is changed
+const configWatchInterval = time.Duration(5) * time.Second
+
+// ReloadResult the result of reloading the configuration
+type ReloadResult struct {
+	Time    string
+	Success bool
+	Error   string   `json:",omitempty"`
+	Changes []string `json:",omitempty"`
+}
+
+// Reloader reload the configuration file and apply the changes to the
+// running proxies. The new proxies are started, the removed proxies are
+// shutdown gracefully, and the backends and request timeout are updated
+// in place. A proxy is restarted if its other settings are changed
+type Reloader struct {
+	sync.Mutex
+	fileName string
+	// the lock of config, the config can be got while reloading
+	configLock sync.Mutex
+	config     *ProxiesConfigure
+	proxyMgr   *ProxyMgr
+	lastResult *ReloadResult
+	// merge the state file to the reloaded configuration if it is not nil
+	persister *Persister
+}
+
+// NewReloader create a Reloader, the config is the running configuration
+func NewReloader(fileName string, config *ProxiesConfigure, proxyMgr *ProxyMgr) *Reloader {
+	return &Reloader{fileName: fileName,
+		config:     config,
+		proxyMgr:   proxyMgr,
+		lastResult: nil,
+		persister:  nil}
+}
+
+// SetPersister set the persister whose state file is merged to the reloaded configuration
+func (r *Reloader) SetPersister(persister *Persister) {
+	r.Lock()
+	defer r.Unlock()
+	r.persister = persister
+}
+
+// GetRunningConfig get the configuration of the running proxies including
+// the changes made through the admin API
+func (r *Reloader) GetRunningConfig() *ProxiesConfigure {
+	config := *r.getConfig()
+
+	config.Proxies = make([]ProxyConf, 0)
+	for _, proxy := range r.proxyMgr.GetAllProxy() {
+		if proxyConf := proxy.GetConf(); proxyConf != nil {
+			config.Proxies = append(config.Proxies, *proxyConf)
+		}
+	}
+	return &config
+}
+
+// GetShutdownTimeout get the shutdown timeout of the running configuration
+func (r *Reloader) GetShutdownTimeout() time.Duration {
+	return convertDuration(r.getConfig().ShutdownTimeout, defaultShutdownTimeout)
+}
+
+func (r *Reloader) getConfig() *ProxiesConfigure {
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	return r.config
+}
+
+func (r *Reloader) setConfig(config *ProxiesConfigure) {
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	r.config = config
+}
+
+// GetLastResult get the result of last reload, nil if it is not reloaded
+func (r *Reloader) GetLastResult() *ReloadResult {
+	r.Lock()
+	defer r.Unlock()
+	return r.lastResult
+}
+
+// Reload load the configuration file and apply the changes
+func (r *Reloader) Reload() *ReloadResult {
+	r.Lock()
+	defer r.Unlock()
+
+	log.WithFields(log.Fields{"file": r.fileName}).Info("Reload configuration")
+	result := &ReloadResult{Time: time.Now().Format(time.RFC3339), Success: false, Changes: make([]string, 0)}
+	config, err := loadConfig(r.fileName)
+	if err == nil && r.persister != nil {
+		err = r.persister.Merge(config)
+	}
+	if err == nil {
+		err = r.apply(config, result)
+	}
+	if err == nil {
+		result.Success = true
+		r.setConfig(config)
+		log.WithFields(log.Fields{"file": r.fileName, "changes": len(result.Changes)}).Info("Succeed to reload configuration")
+	} else {
+		result.Error = err.Error()
+		log.WithFields(log.Fields{"file": r.fileName, "error": err}).Error("Fail to reload configuration")
+	}
+	r.lastResult = result
+	return result
+}
+
+// Watch reload the configuration if the file is changed
+func (r *Reloader) Watch() {
+	lastModTime := time.Time{}
+	if info, err := os.Stat(r.fileName); err == nil {
+		lastModTime = info.ModTime()
+	}
+	for {
+		time.Sleep(configWatchInterval)
+		info, err := os.Stat(r.fileName)
+		if err == nil && !info.ModTime().Equal(lastModTime) {
+			lastModTime = info.ModTime()
+			if r.isPersisted() {
+				log.WithFields(log.Fields{"file": r.fileName}).Info("Skip reloading the configuration written by the admin API")
+				continue
+			}
+			r.Reload()
+		}
+	}
+}
+
+// isPersisted check if the configuration file is written by the persister
+// after the proxies are changed through the admin API
+func (r *Reloader) isPersisted() bool {
+	r.Lock()
+	persister := r.persister
+	r.Unlock()
+
+	if persister == nil {
+		return false
+	}
+	content, err := os.ReadFile(r.fileName)
+	return err == nil && persister.IsLastWritten(r.fileName, content)
+}
+
+// apply create the new and changed proxies first, the running proxies are
+// not changed if any proxy fails to be created. A changed proxy keeps
+// running if its replacement fails to listen
+func (r *Reloader) apply(config *ProxiesConfigure, result *ReloadResult) error {
+	running := r.getConfig()
+	if config.Admin.Addr != running.Admin.Addr || config.Metrics.Addr != running.Metrics.Addr {
+		log.Warn("The change of admin or metrics address is applied after restart")
+	}
+	names := make(map[string]bool)
+	newProxies := make(map[string]*Proxy)
+	for i := range config.Proxies {
+		proxyConf := &config.Proxies[i]
+		if names[proxyConf.Name] {
+			stopProxies(newProxies)
+			return fmt.Errorf("Duplicate proxy %s", proxyConf.Name)
+		}
+		names[proxyConf.Name] = true
+		old, err := r.proxyMgr.GetProxy(proxyConf.Name)
+		if err == nil {
+			if oldConf := old.getConf(); oldConf != nil && !isProxyConfChanged(oldConf, proxyConf) {
+				continue
+			}
+		}
+		proxy, err := createProxy(proxyConf)
+		if err != nil {
+			stopProxies(newProxies)
+			return fmt.Errorf("Fail to create proxy %s: %v", proxyConf.Name, err)
+		}
+		newProxies[proxyConf.Name] = proxy
+	}
+
+	shutdownTimeout := convertDuration(config.ShutdownTimeout, defaultShutdownTimeout)
+	for _, proxy := range r.proxyMgr.GetAllProxy() {
+		if !names[proxy.GetName()] {
+			r.proxyMgr.DeleteProxy(proxy.GetName(), shutdownTimeout)
+			result.Changes = append(result.Changes, fmt.Sprintf("Remove proxy %s", proxy.GetName()))
+		}
+	}
+	failed := make([]string, 0)
+	for i := range config.Proxies {
+		proxyConf := &config.Proxies[i]
+		proxy, ok := newProxies[proxyConf.Name]
+		if !ok {
+			old, _ := r.proxyMgr.GetProxy(proxyConf.Name)
+			result.Changes = append(result.Changes, updateProxy(old, proxyConf)...)
+			continue
+		}
+		replaced, err := r.proxyMgr.ReplaceProxy(proxy, shutdownTimeout)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("Fail to start proxy %s: %v", proxyConf.Name, err))
+		} else if replaced {
+			result.Changes = append(result.Changes, fmt.Sprintf("Restart proxy %s", proxyConf.Name))
+		} else {
+			result.Changes = append(result.Changes, fmt.Sprintf("Add proxy %s", proxyConf.Name))
+		}
+	}
+	for _, change := range result.Changes {
+		log.Info(change)
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// stopProxies stop the proxies which are created but not started
+func stopProxies(proxies map[string]*Proxy) {
+	for _, proxy := range proxies {
+		proxy.Shutdown(0)
+	}
+}
+
+// isProxyConfChanged check if the settings of proxy except the backends
+// and request timeout are changed
+func isProxyConfChanged(oldConf *ProxyConf, newConf *ProxyConf) bool {
+	return !reflect.DeepEqual(getStaticProxyConf(oldConf), getStaticProxyConf(newConf))
+}
+
+// getStaticProxyConf get the settings of proxy which can't be changed in place
+func getStaticProxyConf(proxyConf *ProxyConf) ProxyConf {
+	conf := *proxyConf
+	conf.Backends = nil
+	conf.RequestTimeout = ""
+	conf.Routes = make([]RouteConf, 0, len(proxyConf.Routes))
+	for _, routeConf := range proxyConf.Routes {
+		routeConf.Backends = nil
+		conf.Routes = append(conf.Routes, routeConf)
+	}
+	return conf
+}
+
+// updateProxy update the request timeout and backends of the running proxy,
+// return the changes
+func updateProxy(proxy *Proxy, proxyConf *ProxyConf) []string {
+	changes := make([]string, 0)
+	if proxy.getConf().RequestTimeout != proxyConf.RequestTimeout {
+		proxy.SetRequestTimeout(convertDuration(proxyConf.RequestTimeout, defaultRequestTimeout))
+		changes = append(changes, fmt.Sprintf("Change request timeout of proxy %s", proxy.GetName()))
+	}
+	changes = append(changes, updateBackends(proxy, "", proxyConf.Backends)...)
+	for i := range proxyConf.Routes {
+		changes = append(changes, updateBackends(proxy, getRouteName(&proxyConf.Routes[i]), proxyConf.Routes[i].Backends)...)
+	}
+	proxy.setConf(proxyConf)
+	return changes
+}
+
+// updateBackends add, remove or re-create the backends of route. The backend
+// is re-created if its settings except the weight are changed
+func updateBackends(proxy *Proxy, routeName string, backends []BackendInfo) []string {
+	changes := make([]string, 0)
+	route, err := proxy.router.GetRoute(routeName)
+	if err != nil {
+		return changes
+	}
+	loadBalancer := route.GetLoadBalancer()
+	target := fmt.Sprintf("proxy %s", proxy.GetName())
+	if len(routeName) > 0 {
+		target = fmt.Sprintf("route %s of proxy %s", routeName, proxy.GetName())
+	}
+	running := make(map[string]BackendInfo)
+	for _, info := range loadBalancer.GetBackendInfos() {
+		running[info.Addr] = info
+	}
+	configured := make(map[string]bool)
+	for i := range backends {
+		configured[backends[i].Addr] = true
+	}
+	for addr := range running {
+		if !configured[addr] {
+			loadBalancer.RemoveBackend(addr)
+			changes = append(changes, fmt.Sprintf("Remove backend %s from %s", addr, target))
+		}
+	}
+	for i := range backends {
+		backend := &backends[i]
+		old, ok := running[backend.Addr]
+		if !ok {
+			loadBalancer.AddBackend(backend)
+			changes = append(changes, fmt.Sprintf("Add backend %s to %s", backend.Addr, target))
+		} else if reflect.DeepEqual(old, *backend) {
+			continue
+		} else if isWeightChangedOnly(old, *backend) {
+			loadBalancer.AddBackend(backend)
+			changes = append(changes, fmt.Sprintf("Change weight of backend %s in %s", backend.Addr, target))
+		} else {
+			loadBalancer.RemoveBackend(backend.Addr)
+			loadBalancer.AddBackend(backend)
+			changes = append(changes, fmt.Sprintf("Re-create backend %s in %s", backend.Addr, target))
+		}
+	}
+	return changes
+}
+
+func isWeightChangedOnly(oldInfo BackendInfo, newInfo BackendInfo) bool {
+	oldInfo.Weight = newInfo.Weight
+	return reflect.DeepEqual(oldInfo, newInfo)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, fileName string, content string) {
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getBackendAddrs(proxy *Proxy) []string {
+	result := make([]string, 0)
+	route, _ := proxy.router.GetRoute("")
+	for _, info := range route.GetLoadBalancer().GetBackendInfos() {
+		result = append(result, info.Addr)
+	}
+	return result
+}
+
+func TestReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.yaml")
+	writeConfig(t, fileName, `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    requestTimeout: 1s
+    backends:
+      - addr: "127.0.0.1:10001"
+`)
+	config, err := loadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyMgr := NewProxyMgr()
+	for i := range config.Proxies {
+		if err := proxyMgr.CreateProxy(&config.Proxies[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go proxyMgr.Run()
+	defer proxyMgr.Shutdown(0)
+	reloader := NewReloader(fileName, config, proxyMgr)
+	proxy1, _ := proxyMgr.GetProxy("test-1")
+
+	// update the backends and timeout in place and add a proxy
+	writeConfig(t, fileName, `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    requestTimeout: 2s
+    backends:
+      - addr: "127.0.0.1:10002"
+  - name: test-2
+    listen: "127.0.0.1:0"
+    backends:
+      - addr: "127.0.0.1:10003"
+`)
+	result := reloader.Reload()
+	if !result.Success || len(result.Changes) != 4 {
+		t.Fatalf("The reload result %v is not expected", result)
+	}
+	if proxy, _ := proxyMgr.GetProxy("test-1"); proxy != proxy1 {
+		t.Fatal("The proxy should be updated in place")
+	}
+	if addrs := getBackendAddrs(proxy1); len(addrs) != 1 || addrs[0] != "127.0.0.1:10002" {
+		t.Errorf("The backends %v are not expected", addrs)
+	}
+	if proxy1.getRequestTimeout() != time.Duration(2)*time.Second {
+		t.Error("The request timeout should be changed")
+	}
+	if _, err := proxyMgr.GetProxy("test-2"); err != nil {
+		t.Error("The proxy test-2 should be added")
+	}
+
+	// the running proxies are not changed if the configuration is invalid
+	writeConfig(t, fileName, `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    loadBalancer: unknown
+`)
+	if result = reloader.Reload(); result.Success || len(proxyMgr.GetAllProxy()) != 2 {
+		t.Fatal("The invalid configuration should not be applied")
+	}
+
+	// restart the proxy with changed load balancer and remove a proxy
+	writeConfig(t, fileName, `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    loadBalancer: least-outstanding
+    backends:
+      - addr: "127.0.0.1:10002"
+`)
+	if result = reloader.Reload(); !result.Success || len(result.Changes) != 2 {
+		t.Fatalf("The reload result %v is not expected", result)
+	}
+	if proxy, err := proxyMgr.GetProxy("test-1"); err != nil || proxy == proxy1 {
+		t.Error("The proxy test-1 should be restarted")
+	}
+	if _, err := proxyMgr.GetProxy("test-2"); err == nil {
+		t.Error("The proxy test-2 should be removed")
+	}
+	if reloader.GetLastResult() != result {
+		t.Fail()
+	}
+}
+
+func TestCreateProxyFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	proxyConf := &ProxyConf{Name: "test-1",
+		Listen:   "127.0.0.1:0",
+		Affinity: "unknown",
+		Backends: []BackendInfo{{Addr: ln.Addr().String()}}}
+	if _, err = createProxy(proxyConf); err == nil {
+		t.Fatal("The proxy with unknown affinity should not be created")
+	}
+
+	// the connection to backend is closed if it is connected
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Duration(300) * time.Millisecond))
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 16)); err == nil || isTimeout(err) {
+		t.Errorf("The backend should be stopped after failing to create proxy, but %v", err)
+	}
+}
+
+func TestSkipPersistedReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.yaml")
+	writeConfig(t, fileName, "proxies: []\n")
+	config := &ProxiesConfigure{Proxies: []ProxyConf{{Name: "test-1", Listen: "127.0.0.1:0"}}}
+	reloader := NewReloader(fileName, config, NewProxyMgr())
+	if reloader.isPersisted() {
+		t.Error("The configuration file is not written by persister")
+	}
+	persister := NewPersister(fileName, false)
+	reloader.SetPersister(persister)
+	if err := persister.Save(func() *ProxiesConfigure { return config }, []string{"test-1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reloader.isPersisted() {
+		t.Error("The configuration file written by persister should not be reloaded")
+	}
+	writeConfig(t, fileName, "proxies: []\n")
+	if reloader.isPersisted() {
+		t.Error("The configuration file changed by user should be reloaded")
+	}
+}
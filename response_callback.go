@@ -53,6 +53,14 @@ func (r *ResponseCallbackMgr) Remove(seqId int) (ResponseCallback, bool) {
 	}
 }
 
+// Size get the number of the requests waiting for response
+func (r *ResponseCallbackMgr) Size() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return len(r.responseCallbacks)
+}
+
 func (r *ResponseCallbackMgr) getTimeoutResponses() map[int]*responseWithTimeout {
 	r.Lock()
 	defer r.Unlock()
@@ -80,3 +88,15 @@ func (r *ResponseCallbackMgr) RemoveTimeout(procFunc func(callback ResponseCallb
 	}
 
 }
+
+// RemoveAll remove all the response callbacks and process them by procFunc
+func (r *ResponseCallbackMgr) RemoveAll(procFunc func(callback ResponseCallback)) {
+	r.Lock()
+	items := r.responseCallbacks
+	r.responseCallbacks = make(map[int]*responseWithTimeout)
+	r.Unlock()
+
+	for _, value := range items {
+		procFunc(value.responseCallback)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the number of points on the ring for a backend with weight 1
+const ringPointsPerWeight = 100
+
+type ringPoint struct {
+	hash    uint64
+	backend Backend
+}
+
+// RingHash implements LoadBalancer interface with consistent hashing. The
+// requests with same value of the hash field are sent to the same backend
+// and only a small share of the keys are moved if a backend is added or
+// removed. The requests without the hash field are sent to a random backend
+type RingHash struct {
+	*backendPool
+	hashField int
+	lock      sync.Mutex
+	points    []ringPoint
+	// the backends and their weights when the ring is built
+	ringBackends map[Backend]int
+}
+
+// NewRingHash create a RingHash object hashing the field hashField of
+// the argument struct
+func NewRingHash(hashField int) *RingHash {
+	r := &RingHash{backendPool: newBackendPool(),
+		hashField:    hashField,
+		points:       make([]ringPoint, 0),
+		ringBackends: make(map[Backend]int)}
+	r.selector = r.selectBackend
+	return r
+}
+
+// Send send a request to one of thrift backend server
+func (r *RingHash) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	r.sendWithFailover(request, requestTimeoutTime, r.selectBackend, make(map[Backend]bool), callback)
+}
+
+func (r *RingHash) selectBackend(request *Message, excluded map[Backend]bool) (Backend, error) {
+	backends := r.getSelectableBackends()
+	if len(backends) <= 0 {
+		return nil, noBackendAvailable
+	}
+	var hash uint64
+	key, err := request.GetArgField(r.hashField)
+	if err == nil {
+		hash = hashKey(key)
+	} else {
+		hash = rand.Uint64()
+	}
+
+	points := r.getPoints(backends)
+	n := len(points)
+	index := sort.Search(n, func(i int) bool { return points[i].hash >= hash })
+	// a backend in slow start only takes the keys whose fraction is less
+	// than its slow start factor, other keys go to next backend on the ring
+	fraction := float64(hash&0xffff) / 0x10000
+	var first Backend = nil
+	for i := 0; i < n; i++ {
+		backend := points[(index+i)%n].backend
+		if excluded[backend] {
+			continue
+		}
+		if first == nil {
+			first = backend
+		}
+		if fraction < backend.GetSlowStartFactor() {
+			return backend, nil
+		}
+	}
+	if first != nil {
+		return first, nil
+	}
+	return nil, failedAllBackends
+}
+
+// getPoints get the points of ring, the ring is re-built if the backends
+// or their weights are changed
+func (r *RingHash) getPoints(backends []Backend) []ringPoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changed := len(backends) != len(r.ringBackends)
+	for i := 0; !changed && i < len(backends); i++ {
+		weight, ok := r.ringBackends[backends[i]]
+		changed = !ok || weight != backends[i].GetWeight()
+	}
+	if !changed {
+		return r.points
+	}
+
+	points := make([]ringPoint, 0)
+	ringBackends := make(map[Backend]int)
+	for _, backend := range backends {
+		weight := backend.GetWeight()
+		ringBackends[backend] = weight
+		for i := 0; i < weight*ringPointsPerWeight; i++ {
+			points = append(points, ringPoint{hash: hashKey(fmt.Sprintf("%s-%d", backend.GetAddr(), i)),
+				backend: backend})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r.points = points
+	r.ringBackends = ringBackends
+	return points
+}
+
+// hashKey hash the key to a 64 bits integer
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// mix the bits since the keys are often similar
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the separator between service name and method name
+// added by thrift TMultiplexedProtocol
+const multiplexedSeparator = ":"
+
+// splitServiceName split the name of a multiplexed call to service
+// name and method name. The service name is empty if the call is
+// not multiplexed
+func splitServiceName(name string) (service string, method string) {
+	pos := strings.Index(name, multiplexedSeparator)
+	if pos == -1 {
+		return "", name
+	}
+	return name[0:pos], name[pos+len(multiplexedSeparator):]
+}
+
+// RouteMatcher check if a request should be forwarded by a route
+type RouteMatcher struct {
+	service      string
+	method       string
+	methodPrefix string
+	methodRegex  *regexp.Regexp
+}
+
+// NewRouteMatcher create a RouteMatcher from configuration. The requests
+// must match all the configured conditions
+func NewRouteMatcher(matchConf *RouteMatchConf) (*RouteMatcher, error) {
+	matcher := &RouteMatcher{service: matchConf.Service,
+		method:       matchConf.Method,
+		methodPrefix: matchConf.MethodPrefix,
+		methodRegex:  nil}
+	if len(matchConf.MethodRegex) > 0 {
+		r, err := regexp.Compile(matchConf.MethodRegex)
+		if err != nil {
+			return nil, err
+		}
+		matcher.methodRegex = r
+	}
+	return matcher, nil
+}
+
+// IsEmpty check if no condition is set, the empty RouteMatcher matches all the requests
+func (m *RouteMatcher) IsEmpty() bool {
+	return len(m.service) <= 0 && len(m.method) <= 0 && len(m.methodPrefix) <= 0 && m.methodRegex == nil
+}
+
+// Match check if the call name matches this RouteMatcher. The method
+// conditions are checked against the method name without the service prefix
+func (m *RouteMatcher) Match(name string) bool {
+	service, method := splitServiceName(name)
+	if len(m.service) > 0 && service != m.service {
+		return false
+	}
+	if len(m.method) > 0 && method != m.method {
+		return false
+	}
+	if len(m.methodPrefix) > 0 && !strings.HasPrefix(method, m.methodPrefix) {
+		return false
+	}
+	if m.methodRegex != nil && !m.methodRegex.MatchString(method) {
+		return false
+	}
+	return true
+}
+
+// Route forward the matched requests to its own backend servers
+type Route struct {
+	name               string
+	matcher            *RouteMatcher
+	stripServicePrefix bool
+	loadBalancer       LoadBalancer
+}
+
+// NewRoute create a Route object. If stripServicePrefix is true, the
+// service name is removed from the call name before forwarding to the
+// backend servers
+func NewRoute(name string,
+	matcher *RouteMatcher,
+	stripServicePrefix bool,
+	loadBalancer LoadBalancer) *Route {
+	return &Route{name: name,
+		matcher:            matcher,
+		stripServicePrefix: stripServicePrefix,
+		loadBalancer:       loadBalancer}
+}
+
+func (r *Route) GetName() string {
+	return r.name
+}
+
+func (r *Route) GetLoadBalancer() LoadBalancer {
+	return r.loadBalancer
+}
+
+// Send send the request to the backend servers of this route
+func (r *Route) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	r.SendWithAffinity(nil, request, requestTimeoutTime, callback)
+}
+
+// SendWithAffinity send the request to the backend bound in affinity, the
+// affinity is not used if it is nil
+func (r *Route) SendWithAffinity(affinity *Affinity, request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	if r.stripServicePrefix {
+		name, err := request.GetName()
+		if err == nil {
+			service, method := splitServiceName(name)
+			if len(service) > 0 {
+				err = request.SetName(method)
+			}
+		}
+		if err != nil {
+			callback(nil, err)
+			return
+		}
+	}
+	if affinity == nil {
+		r.loadBalancer.Send(request, requestTimeoutTime, callback)
+	} else {
+		r.loadBalancer.SendWithAffinity(affinity, request, requestTimeoutTime, callback)
+	}
+}
+
+// Router select a route for each request by the call name. The
+// requests match none of the routes are sent by the default route
+type Router struct {
+	sync.Mutex
+	defaultRoute *Route
+	routes       []*Route
+}
+
+// NewRouter create a Router, the requests not matched by any routes
+// are sent to the defaultLoadBalancer
+func NewRouter(defaultLoadBalancer LoadBalancer) *Router {
+	return &Router{defaultRoute: NewRoute("", &RouteMatcher{}, false, defaultLoadBalancer),
+		routes: make([]*Route, 0)}
+}
+
+// AddRoute append a route, the routes are matched in the order they are added
+func (r *Router) AddRoute(route *Route) error {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, t := range r.routes {
+		if t.name == route.name {
+			return fmt.Errorf("Route %s already exists", route.name)
+		}
+	}
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+// GetRoute get route by name, the empty name is for the default route
+func (r *Router) GetRoute(name string) (*Route, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if name == r.defaultRoute.name {
+		return r.defaultRoute, nil
+	}
+	for _, route := range r.routes {
+		if route.name == name {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("No such route %s", name)
+}
+
+// GetAllRoutes get all the routes including the default route
+func (r *Router) GetAllRoutes() []*Route {
+	r.Lock()
+	defer r.Unlock()
+
+	result := make([]*Route, 0)
+	result = append(result, r.defaultRoute)
+	return append(result, r.routes...)
+}
+
+func (r *Router) findRoute(name string) *Route {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, route := range r.routes {
+		if route.matcher.Match(name) {
+			return route
+		}
+	}
+	return r.defaultRoute
+}
+
+// Send send the request by the first matched route
+func (r *Router) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	r.SendWithAffinity(nil, request, requestTimeoutTime, callback)
+}
+
+// SendWithAffinity send the request by the first matched route to the backend
+// bound in affinity
+func (r *Router) SendWithAffinity(affinity *Affinity, request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	name, err := request.GetName()
+	if err != nil {
+		callback(nil, err)
+		return
+	}
+	r.findRoute(name).SendWithAffinity(affinity, request, requestTimeoutTime, callback)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordLoadBalancer records the names of the requests sent to it
+type recordLoadBalancer struct {
+	names []string
+}
+
+func newRecordLoadBalancer() *recordLoadBalancer {
+	return &recordLoadBalancer{names: make([]string, 0)}
+}
+
+func (r *recordLoadBalancer) AddBackend(backendInfo *BackendInfo) {
+}
+
+func (r *recordLoadBalancer) RemoveBackend(addr string) error {
+	return nil
+}
+
+func (r *recordLoadBalancer) DrainBackend(addr string) error {
+	return nil
+}
+
+func (r *recordLoadBalancer) GetBackendInfos() []BackendInfo {
+	return make([]BackendInfo, 0)
+}
+
+func (r *recordLoadBalancer) GetAllBackends() []Backend {
+	return make([]Backend, 0)
+}
+
+func (r *recordLoadBalancer) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	name, _ := request.GetName()
+	r.names = append(r.names, name)
+	callback(request, nil)
+}
+
+func (r *recordLoadBalancer) Stop() {
+}
+
+func (r *recordLoadBalancer) GetEjection(backend Backend) *Ejection {
+	return nil
+}
+
+func (r *recordLoadBalancer) SendWithAffinity(affinity *Affinity, request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	r.Send(request, requestTimeoutTime, callback)
+}
+
+func newServiceMatcher(service string) *RouteMatcher {
+	matcher, _ := NewRouteMatcher(&RouteMatchConf{Service: service})
+	return matcher
+}
+
+func sendCall(sender Sender, protocol ProtocolType, name string) {
+	msg := createInternalErrorException(protocol, true, name, 1, "")
+	sender.Send(msg, time.Now(), func(response *Message, err error) {})
+}
+
+func TestRouteMultiplexedService(t *testing.T) {
+	defaultLb := newRecordLoadBalancer()
+	userLb := newRecordLoadBalancer()
+	orderLb := newRecordLoadBalancer()
+	router := NewRouter(defaultLb)
+	router.AddRoute(NewRoute("user", newServiceMatcher("UserService"), true, userLb))
+	router.AddRoute(NewRoute("order", newServiceMatcher("OrderService"), false, orderLb))
+
+	sendCall(router, BinaryProtocolType, "UserService:getUser")
+	sendCall(router, CompactProtocolType, "UserService:addUser")
+	sendCall(router, BinaryProtocolType, "OrderService:getOrder")
+	sendCall(router, BinaryProtocolType, "ping")
+
+	if len(userLb.names) != 2 || userLb.names[0] != "getUser" || userLb.names[1] != "addUser" {
+		t.Errorf("Unexpected requests of user route: %v", userLb.names)
+	}
+	if len(orderLb.names) != 1 || orderLb.names[0] != "OrderService:getOrder" {
+		t.Errorf("Unexpected requests of order route: %v", orderLb.names)
+	}
+	if len(defaultLb.names) != 1 || defaultLb.names[0] != "ping" {
+		t.Errorf("Unexpected requests of default route: %v", defaultLb.names)
+	}
+	if router.AddRoute(NewRoute("user", newServiceMatcher("UserService"), true, userLb)) == nil {
+		t.Error("Duplicated route should not be added")
+	}
+}
+
+func TestSetName(t *testing.T) {
+	for _, protocol := range []ProtocolType{BinaryProtocolType, CompactProtocolType} {
+		msg := createInternalErrorException(protocol, true, "Service:method", 300, "error")
+		if err := msg.SetName("method"); err != nil {
+			t.Fatal(err)
+		}
+		name, _ := msg.GetName()
+		seqId, _ := msg.GetSeqId()
+		n, _ := readInt(msg.buffer, 0)
+		if name != "method" || seqId != 300 || n != len(msg.buffer)-4 {
+			t.Errorf("Fail to set name of %s message", protocol.String())
+		}
+	}
+}
+
+func TestRouteByMethodName(t *testing.T) {
+	defaultLb := newRecordLoadBalancer()
+	exactLb := newRecordLoadBalancer()
+	prefixLb := newRecordLoadBalancer()
+	regexLb := newRecordLoadBalancer()
+	router := NewRouter(defaultLb)
+	exact, _ := NewRouteMatcher(&RouteMatchConf{Method: "report"})
+	prefix, _ := NewRouteMatcher(&RouteMatchConf{MethodPrefix: "report"})
+	regex, err := NewRouteMatcher(&RouteMatchConf{MethodRegex: "^batch[A-Z]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddRoute(NewRoute("exact", exact, false, exactLb))
+	router.AddRoute(NewRoute("prefix", prefix, false, prefixLb))
+	router.AddRoute(NewRoute("regex", regex, false, regexLb))
+
+	for _, name := range []string{"report", "reportDaily", "batchGet", "batchget", "get"} {
+		sendCall(router, BinaryProtocolType, name)
+	}
+	if len(exactLb.names) != 1 || len(prefixLb.names) != 1 || prefixLb.names[0] != "reportDaily" {
+		t.Error("The routes are not matched in order")
+	}
+	if len(regexLb.names) != 1 || regexLb.names[0] != "batchGet" {
+		t.Errorf("Unexpected requests of regex route: %v", regexLb.names)
+	}
+	if len(defaultLb.names) != 2 {
+		t.Errorf("Unexpected requests of default route: %v", defaultLb.names)
+	}
+
+	matcher, _ := NewRouteMatcher(&RouteMatchConf{Service: "Calc", Method: "add"})
+	if !matcher.Match("Calc:add") || matcher.Match("Calc:sub") || matcher.Match("Other:add") {
+		t.Error("The method should be matched without the service prefix")
+	}
+
+	if _, err := NewRouteMatcher(&RouteMatchConf{MethodRegex: "("}); err == nil {
+		t.Error("Invalid regex should be rejected")
+	}
+}
+
+func TestRouteMalformedName(t *testing.T) {
+	defaultLb := newRecordLoadBalancer()
+	methodLb := newRecordLoadBalancer()
+	router := NewRouter(defaultLb)
+	matcher, _ := NewRouteMatcher(&RouteMatchConf{Method: "add"})
+	router.AddRoute(NewRoute("method", matcher, true, methodLb))
+
+	// the length of name is beyond the message
+	msg := NewMessage([]byte{0, 0, 0, 0x0c, 0x80, 1, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	for _, affinity := range []*Affinity{nil, NewAffinity("127.0.0.1:1234")} {
+		var result error
+		router.SendWithAffinity(affinity, msg, time.Now(), func(response *Message, err error) {
+			result = err
+		})
+		if result == nil {
+			t.Error("The request with malformed name should fail")
+		}
+	}
+	if len(defaultLb.names) != 0 || len(methodLb.names) != 0 {
+		t.Error("The request with malformed name should not be routed")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the random source to decide if a backend in slow start accepts a request
+var slowStartRandom = rand.Float64
+
+// SlowStart ramp up the share of requests of a backend from a small
+// fraction to full in a window after the backend is added or recovered
+type SlowStart struct {
+	sync.Mutex
+	window      time.Duration
+	exponential bool
+	minFactor   float64
+	start       time.Time
+}
+
+// NewSlowStart create a SlowStart from configuration
+func NewSlowStart(conf *SlowStartConf) *SlowStart {
+	minFactor := float64(conf.MinWeightPercent) / 100
+	if minFactor <= 0 || minFactor > 1 {
+		minFactor = 0.1
+	}
+	return &SlowStart{window: convertDuration(conf.Window, time.Duration(30)*time.Second),
+		exponential: conf.Mode == "exponential",
+		minFactor:   minFactor,
+		start:       time.Now()}
+}
+
+// Restart start the slow start window again
+func (s *SlowStart) Restart() {
+	s.Lock()
+	defer s.Unlock()
+	s.start = time.Now()
+}
+
+// GetFactor get the factor of weight in range [minFactor, 1]
+func (s *SlowStart) GetFactor() float64 {
+	s.Lock()
+	elapsed := time.Since(s.start)
+	s.Unlock()
+
+	if elapsed >= s.window {
+		return 1
+	}
+	progress := float64(elapsed) / float64(s.window)
+	if s.exponential {
+		return s.minFactor * math.Pow(1/s.minFactor, progress)
+	}
+	return s.minFactor + (1-s.minFactor)*progress
+}
+
+// slowStartAccepted check if the backend accepts a request, the backend
+// in slow start accepts requests in proportion to its slow start factor
+func slowStartAccepted(backend Backend) bool {
+	factor := backend.GetSlowStartFactor()
+	return factor >= 1 || slowStartRandom() < factor
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Codec the protocol and transport of thrift messages on a connection
+type Codec struct {
+	protocol  ProtocolType
+	transport Transport
+}
+
+// NewCodec create a Codec object
+func NewCodec(protocol ProtocolType, transport Transport) *Codec {
+	return &Codec{protocol: protocol, transport: transport}
+}
+
+// Translator re-encode the requests from clients to the protocol and
+// transport of backend servers and the responses from backend servers
+// back to the protocol and transport used by the client
+type Translator struct {
+	backendCodec *Codec
+	sender       Sender
+}
+
+// NewTranslator create a Translator which sends the translated requests by sender
+func NewTranslator(backendCodec *Codec, sender Sender) (*Translator, error) {
+	if backendCodec.protocol == AutoProtocolType || backendCodec.transport == AutoTransport {
+		return nil, errors.New("The protocol and transport of backend must not be auto")
+	}
+	return &Translator{backendCodec: backendCodec, sender: sender}, nil
+}
+
+// Send translate the request and send it to the backend
+func (t *Translator) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	protocol := request.GetProtocol()
+	framed := request.isFramed()
+	backendRequest, err := translateMessage(request,
+		t.backendCodec.protocol,
+		t.backendCodec.transport == FramedTransport)
+	if err != nil {
+		callback(nil, err)
+		return
+	}
+	t.sender.Send(backendRequest, requestTimeoutTime, func(response *Message, err error) {
+		if err == nil {
+			response, err = translateMessage(response, protocol, framed)
+		}
+		callback(response, err)
+	})
+}
+
+// translateMessage encode the message with protocol and framed transport
+// if framed is true, otherwise with buffered transport
+func translateMessage(msg *Message, protocol ProtocolType, framed bool) (*Message, error) {
+	if msg.GetProtocol() == protocol {
+		if msg.isFramed() == framed {
+			return msg, nil
+		}
+		// only the frame length is added or removed
+		if framed {
+			b := make([]byte, 4, len(msg.buffer)+4)
+			writeInt(b, 0, len(msg.buffer))
+			return NewMessage(append(b, msg.buffer...)), nil
+		}
+		return NewMessage(msg.buffer[4:]), nil
+	}
+
+	reader := newProtocolReader(msg.GetProtocol(), msg.buffer, msg.headerOffset())
+	writer := newProtocolWriter(protocol, framed)
+	name, msgType, seqId, err := reader.ReadMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	writer.BeginMessage(name, msgType, seqId)
+	err = copyStruct(reader, writer, 0)
+	if err != nil {
+		return nil, err
+	}
+	writer.EndMessage()
+	return writer.ToMessage(), nil
+}
+
+func copyStruct(reader ProtocolReader, writer ProtocolWriter, depth int) error {
+	if depth > maxNestingDepth {
+		return invalidMessage
+	}
+	err := reader.ReadStructBegin()
+	if err != nil {
+		return err
+	}
+	writer.BeginStruct()
+	for {
+		fieldType, fieldId, err := reader.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if fieldType == STOP {
+			writer.StopField()
+			break
+		}
+		writer.BeginField(fieldType, fieldId)
+		err = copyValue(reader, writer, fieldType, depth)
+		if err != nil {
+			return err
+		}
+		writer.EndField()
+	}
+	writer.EndStruct()
+	return reader.ReadStructEnd()
+}
+
+// copyValue read a value with type fieldType from reader and write it to writer
+func copyValue(reader ProtocolReader, writer ProtocolWriter, fieldType FieldType, depth int) error {
+	if depth > maxNestingDepth {
+		return invalidMessage
+	}
+	switch fieldType {
+	case BOOL:
+		v, err := reader.ReadBool()
+		writer.WriteBool(v)
+		return err
+	case BYTE:
+		v, err := reader.ReadByte()
+		writer.WriteI8(v)
+		return err
+	case I16:
+		v, err := reader.ReadI16()
+		writer.WriteI16(v)
+		return err
+	case I32:
+		v, err := reader.ReadI32()
+		writer.WriteInt32(int(v))
+		return err
+	case I64:
+		v, err := reader.ReadI64()
+		writer.WriteI64(v)
+		return err
+	case DOUBLE:
+		v, err := reader.ReadDouble()
+		writer.WriteDouble(v)
+		return err
+	case STRING:
+		v, err := reader.ReadBinary()
+		writer.WriteBytes(v)
+		return err
+	case UUID:
+		v, err := reader.ReadUUID()
+		writer.WriteUUID(v)
+		return err
+	case STRUCT:
+		return copyStruct(reader, writer, depth+1)
+	case MAP:
+		keyType, valueType, size, err := reader.ReadMapBegin()
+		if err != nil {
+			return err
+		}
+		writer.BeginMap(keyType, valueType, size)
+		for i := 0; err == nil && i < size; i++ {
+			err = copyValue(reader, writer, keyType, depth+1)
+			if err == nil {
+				err = copyValue(reader, writer, valueType, depth+1)
+			}
+		}
+		writer.EndMap()
+		return err
+	case LIST:
+		elemType, size, err := reader.ReadListBegin()
+		if err != nil {
+			return err
+		}
+		writer.BeginList(elemType, size)
+		for i := 0; err == nil && i < size; i++ {
+			err = copyValue(reader, writer, elemType, depth+1)
+		}
+		writer.EndList()
+		return err
+	case SET:
+		elemType, size, err := reader.ReadSetBegin()
+		if err != nil {
+			return err
+		}
+		writer.BeginSet(elemType, size)
+		for i := 0; err == nil && i < size; i++ {
+			err = copyValue(reader, writer, elemType, depth+1)
+		}
+		writer.EndSet()
+		return err
+	default:
+		return invalidMessage
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// writeTestMessage write a call with all kinds of thrift types
+func writeTestMessage(writer ProtocolWriter) *Message {
+	writer.BeginMessage("getUser", Call, 42)
+	writer.BeginStruct()
+	writer.BeginField(BOOL, 1)
+	writer.WriteBool(true)
+	writer.BeginField(BOOL, 2)
+	writer.WriteBool(false)
+	writer.BeginField(I64, 3)
+	writer.WriteI64(-1234567890123)
+	writer.BeginField(DOUBLE, 40)
+	writer.WriteDouble(3.25)
+	writer.BeginField(STRUCT, 5)
+	writer.BeginStruct()
+	writer.BeginField(I16, 2)
+	writer.WriteI16(-7)
+	writer.BeginField(STRING, 20)
+	writer.WriteString("nested")
+	writer.StopField()
+	writer.EndStruct()
+	writer.BeginField(MAP, 6)
+	writer.BeginMap(STRING, I32, 2)
+	writer.WriteString("a")
+	writer.WriteInt32(1)
+	writer.WriteString("b")
+	writer.WriteInt32(-2)
+	writer.EndMap()
+	writer.BeginField(LIST, 7)
+	writer.BeginList(BOOL, 20)
+	for i := 0; i < 20; i++ {
+		writer.WriteBool(i%2 == 0)
+	}
+	writer.EndList()
+	writer.BeginField(SET, 8)
+	writer.BeginSet(BYTE, 1)
+	writer.WriteI8(9)
+	writer.EndSet()
+	writer.StopField()
+	writer.EndStruct()
+	writer.EndMessage()
+	return writer.ToMessage()
+}
+
+func TestTranslateBinaryToCompact(t *testing.T) {
+	binaryMsg := writeTestMessage(NewBinaryProtocol(false))
+	compactMsg, err := translateMessage(binaryMsg, CompactProtocolType, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := writeTestMessage(NewCompactProtocol(true))
+	if !bytes.Equal(compactMsg.buffer, expected.buffer) {
+		t.Fatal("The translated compact message is not expected")
+	}
+
+	name, _ := compactMsg.GetName()
+	seqId, _ := compactMsg.GetSeqId()
+	if name != "getUser" || seqId != 42 || compactMsg.GetType() != int(Call) {
+		t.Fail()
+	}
+
+	msg, err := translateMessage(compactMsg, BinaryProtocolType, false)
+	if err != nil || !bytes.Equal(msg.buffer, binaryMsg.buffer) {
+		t.Fatal("Fail to translate the compact message back to binary")
+	}
+}
+
+func TestTranslateTransport(t *testing.T) {
+	msg := writeTestMessage(NewBinaryProtocol(false))
+	framedMsg, err := translateMessage(msg, BinaryProtocolType, true)
+	if err != nil || !framedMsg.isFramed() || !bytes.Equal(framedMsg.buffer[4:], msg.buffer) {
+		t.Fatal("Fail to add the frame length")
+	}
+	n, _ := readInt(framedMsg.buffer, 0)
+	if n != len(msg.buffer) {
+		t.Fail()
+	}
+	unframedMsg, _ := translateMessage(framedMsg, BinaryProtocolType, false)
+	if !bytes.Equal(unframedMsg.buffer, msg.buffer) {
+		t.Fail()
+	}
+}
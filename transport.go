@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Transport the thrift transport used on a connection
+type Transport int
+
+const (
+	// FramedTransport every message is prefixed with a 4 bytes length
+	FramedTransport Transport = iota
+	// BufferedTransport messages are sent without length prefix
+	BufferedTransport
+	// AutoTransport detect the transport from the first message
+	AutoTransport
+)
+
+// parseTransport parse the transport from configuration, the
+// framed transport is used if no transport is configured
+func parseTransport(transport string) (Transport, error) {
+	switch transport {
+	case "", "framed":
+		return FramedTransport, nil
+	case "buffered":
+		return BufferedTransport, nil
+	case "auto":
+		return AutoTransport, nil
+	default:
+		return FramedTransport, fmt.Errorf("Unknown transport %s", transport)
+	}
+}
+
+func (t Transport) String() string {
+	switch t {
+	case FramedTransport:
+		return "framed"
+	case BufferedTransport:
+		return "buffered"
+	default:
+		return "auto"
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the environment variables to pass the listening sockets to the upgraded process.
+// The addresses of listeners are separated by comma in the order of the inherited
+// file descriptors starting from 3
+const envInheritedListeners = "THRIFTPROXY_LISTENERS"
+
+// the file descriptor to notify the parent process that the upgraded process is started
+const envUpgradeReadyFd = "THRIFTPROXY_UPGRADE_READY_FD"
+
+// the time to wait for the upgraded process to start
+const upgradeTimeout = time.Duration(30) * time.Second
+
+var upgradeNotSupportedError error = errors.New("Upgrade is not supported on this platform")
+
+// trackedListener a listener which can be passed to the upgraded process
+type trackedListener struct {
+	net.Listener
+	addr string
+	mgr  *ListenerMgr
+}
+
+// Close close the listener and stop passing it to the upgraded process
+func (l *trackedListener) Close() error {
+	l.mgr.remove(l)
+	return l.Listener.Close()
+}
+
+// ListenerMgr manage the listening sockets of the process, the sockets
+// are inherited from the parent process if it is upgraded
+type ListenerMgr struct {
+	sync.Mutex
+	listeners []*trackedListener
+	inherited map[string]net.Listener
+}
+
+var listenerMgr = &ListenerMgr{listeners: make([]*trackedListener, 0),
+	inherited: make(map[string]net.Listener)}
+
+// listen listen on the addr, the listener inherited from the parent process is used if it exists
+func listen(addr string) (net.Listener, error) {
+	return listenerMgr.listen(addr)
+}
+
+func (m *ListenerMgr) listen(addr string) (net.Listener, error) {
+	m.Lock()
+	defer m.Unlock()
+	ln, ok := m.inherited[addr]
+	if ok {
+		delete(m.inherited, addr)
+		log.WithFields(log.Fields{"address": addr}).Info("Use the listener inherited from parent process")
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l := &trackedListener{Listener: ln, addr: addr, mgr: m}
+	m.listeners = append(m.listeners, l)
+	return l, nil
+}
+
+func (m *ListenerMgr) remove(l *trackedListener) {
+	m.Lock()
+	defer m.Unlock()
+	for i, t := range m.listeners {
+		if t == l {
+			m.listeners = append(m.listeners[0:i], m.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *ListenerMgr) getListeners() []*trackedListener {
+	m.Lock()
+	defer m.Unlock()
+	result := make([]*trackedListener, len(m.listeners))
+	copy(result, m.listeners)
+	return result
+}
+
+// loadInherited load the listeners passed by the parent process
+func (m *ListenerMgr) loadInherited() error {
+	value := os.Getenv(envInheritedListeners)
+	if len(value) <= 0 {
+		return nil
+	}
+	os.Unsetenv(envInheritedListeners)
+
+	m.Lock()
+	defer m.Unlock()
+	for i, addr := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Fail to inherit listener %s: %v", addr, err)
+		}
+		m.inherited[addr] = ln
+	}
+	return nil
+}
+
+// closeInherited close the inherited listeners not used by this process
+func (m *ListenerMgr) closeInherited() {
+	m.Lock()
+	defer m.Unlock()
+	for addr, ln := range m.inherited {
+		log.WithFields(log.Fields{"address": addr}).Info("Close the unused listener inherited from parent process")
+		ln.Close()
+	}
+	m.inherited = make(map[string]net.Listener)
+}
+
+// closeAll close all the listeners of this process
+func (m *ListenerMgr) closeAll() {
+	for _, l := range m.getListeners() {
+		l.Close()
+	}
+}
+
+// notifyUpgradeReady notify the parent process that this process is started
+// if it is started by upgrading
+func notifyUpgradeReady() {
+	value := os.Getenv(envUpgradeReadyFd)
+	if len(value) <= 0 {
+		return
+	}
+	os.Unsetenv(envUpgradeReadyFd)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	f.Write([]byte{1})
+	f.Close()
+	log.Info("Notify the parent process that the upgrade is done")
+}
+
+// startUpgradedProcess start the executable of this process again with the
+// listening sockets, and wait until the new process is started
+func startUpgradedProcess() error {
+	if len(upgradeSignals) <= 0 {
+		return upgradeNotSupportedError
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listeners := listenerMgr.getListeners()
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	addrs := make([]string, 0, len(listeners))
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		tcpListener, ok := l.Listener.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tcpListener.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		addrs = append(addrs, l.addr)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+
+	env := append(os.Environ(),
+		fmt.Sprintf("%s=%s", envInheritedListeners, strings.Join(addrs, ",")),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFd, len(files)-1))
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		return err
+	}
+	// the reading is failed if the new process exits before it is ready
+	readyWriter.Close()
+	files = files[0 : len(files)-1]
+	log.WithFields(log.Fields{"pid": process.Pid, "listeners": len(addrs)}).Info("Start the upgraded process")
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyReader.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("Timeout to wait for the upgraded process")
+	}
+	if err != nil {
+		process.Kill()
+		process.Wait()
+		return err
+	}
+	process.Release()
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenerMgr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := &ListenerMgr{listeners: make([]*trackedListener, 0),
+		inherited: map[string]net.Listener{"test:9090": ln}}
+
+	l, err := mgr.listen("test:9090")
+	if err != nil || l.Addr().String() != ln.Addr().String() {
+		t.Fatal("The inherited listener should be used")
+	}
+	other, err := mgr.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if len(mgr.inherited) != 0 || len(mgr.getListeners()) != 2 {
+		t.Fatal("The listeners should be tracked")
+	}
+	l.Close()
+	if listeners := mgr.getListeners(); len(listeners) != 1 || listeners[0] != other {
+		t.Error("The closed listener should not be tracked")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// the signals to upgrade the process
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,84 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is not a real test, it is run as the upgraded process
+// by TestInheritListener to accept a connection on the inherited listener
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	mgr := &ListenerMgr{listeners: make([]*trackedListener, 0),
+		inherited: make(map[string]net.Listener)}
+	if err := mgr.loadInherited(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(mgr.inherited) != 1 {
+		fmt.Fprintln(os.Stderr, "The listener is not inherited")
+		os.Exit(1)
+	}
+	ln, err := mgr.listen("test:9090")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conn.Write([]byte("ok"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestInheritListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	// the listener is passed as file descriptor 3 like startUpgradedProcess
+	t.Setenv(envInheritedListeners, "test:9090")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// only the child process can accept the connection
+	ln.Close()
+	defer cmd.Process.Kill()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(5)*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Duration(10) * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "ok" {
+		t.Fatalf("The connection should be accepted by the child process, but got %q: %v", b, err)
+	}
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("The child process fails: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// the upgrade is not supported on windows
+var upgradeSignals = []os.Signal{}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -59,36 +64,101 @@ func createReadiness(addr string, readinessConf *ReadinessConf) Readiness {
 	if strings.Index(ip, ":") != -1 && !strings.HasPrefix(ip, "[") {
 		ip = fmt.Sprintf("[%s]", ip)
 	}
+	timeout := convertDuration(readinessConf.Timeout, time.Duration(5)*time.Second)
 	switch readinessConf.Protocol {
 	case "tcp":
-		return NewTcpReadiness(fmt.Sprintf("%s:%d", ip, readinessConf.Port))
-	case "http":
+		return NewTcpReadiness(fmt.Sprintf("%s:%d", ip, readinessConf.Port), timeout)
+	case "http", "https":
 		path := "/"
 		if len(readinessConf.Path) > 0 {
 			path = readinessConf.Path
 		}
-		url := fmt.Sprintf("http://%s:%d%s", ip, readinessConf.Port, path)
-		return NewHttpReadiness(url)
+		client, err := createHttpClient(readinessConf, false, timeout)
+		if err != nil {
+			log.WithFields(log.Fields{"address": addr, "error": err}).Error("Fail to create the readiness probe")
+			return &failedReadiness{}
+		}
+		url := fmt.Sprintf("%s://%s:%d%s", readinessConf.Protocol, ip, readinessConf.Port, path)
+		return NewHttpReadiness(url, client, readinessConf)
+	case "grpc":
+		client, err := createHttpClient(readinessConf, true, timeout)
+		if err != nil {
+			log.WithFields(log.Fields{"address": addr, "error": err}).Error("Fail to create the readiness probe")
+			return &failedReadiness{}
+		}
+		scheme := "http"
+		if readinessConf.TLS != nil {
+			scheme = "https"
+		}
+		return NewGrpcReadiness(fmt.Sprintf("%s://%s:%d", scheme, ip, readinessConf.Port), readinessConf.Service, client)
+	case "exec":
+		return NewExecReadiness(readinessConf.Command, timeout)
 	default:
 		return NewNullReadiness()
 	}
 }
 
-func convertDuration(duration string, defDuration time.Duration) time.Duration {
-	n := len(duration)
-	if n <= 0 {
-		return defDuration
+// createHttpClient create the http client for readiness probe. The TLS is
+// enabled if it is configured or the protocol is https. If http2 is true,
+// only HTTP/2 is used and it is unencrypted if the TLS is not enabled
+func createHttpClient(readinessConf *ReadinessConf, http2 bool, timeout time.Duration) (*http.Client, error) {
+	transport := &http.Transport{}
+	if readinessConf.TLS != nil || readinessConf.Protocol == "https" {
+		tlsConf := readinessConf.TLS
+		if tlsConf == nil {
+			tlsConf = &TLSConf{}
+		}
+		tlsConfig := &tls.Config{ServerName: tlsConf.ServerName,
+			InsecureSkipVerify: tlsConf.InsecureSkipVerify}
+		if len(tlsConf.CAFile) > 0 {
+			b, err := os.ReadFile(tlsConf.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("No certificate is found in %s", tlsConf.CAFile)
+			}
+		}
+		transport.TLSClientConfig = tlsConfig
 	}
+	if http2 {
+		transport.Protocols = new(http.Protocols)
+		if transport.TLSClientConfig != nil {
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+var invalidDurationError error = errors.New("Invalid duration, it should be like 100ms or 10s")
+
+// parseDuration parse the duration in milliseconds with suffix "ms" or in seconds with suffix "s"
+func parseDuration(duration string) (time.Duration, error) {
+	n := len(duration)
 	if strings.HasSuffix(duration, "ms") {
 		t, err := strconv.Atoi(duration[0 : n-2])
-		if err == nil {
-			return time.Duration(t) * time.Millisecond
+		if err == nil && t >= 0 {
+			return time.Duration(t) * time.Millisecond, nil
 		}
 	} else if strings.HasSuffix(duration, "s") {
 		t, err := strconv.Atoi(duration[0 : n-1])
-		if err == nil {
-			return time.Duration(t) * time.Second
+		if err == nil && t >= 0 {
+			return time.Duration(t) * time.Second, nil
 		}
 	}
-	return defDuration
+	return 0, invalidDurationError
+}
+
+func convertDuration(duration string, defDuration time.Duration) time.Duration {
+	if len(duration) <= 0 {
+		return defDuration
+	}
+	t, err := parseDuration(duration)
+	if err != nil {
+		return defDuration
+	}
+	return t
 }
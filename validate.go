@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the protocols supported by readiness probe
+var readinessProtocols = []string{"tcp", "http", "https", "grpc", "exec"}
+
+var missingHostError error = errors.New("the host is missing")
+var invalidPortError error = errors.New("the port is not valid")
+
+// ConfigError the problems found in the configuration file
+type ConfigError struct {
+	FileName string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid configuration %s:\n  %s", e.FileName, strings.Join(e.Problems, "\n  "))
+}
+
+// configValidator check the decoded configuration, the problems are
+// reported with the line numbers found in the yaml node tree
+type configValidator struct {
+	root     *yaml.Node
+	problems []string
+}
+
+// validateConfig decode the configuration strictly and check it, the unknown
+// keys are rejected
+func validateConfig(fileName string, content []byte) (*ProxiesConfigure, error) {
+	config := &ProxiesConfigure{}
+	v, err := newConfigValidator(fileName, content, config)
+	if err != nil {
+		return nil, err
+	}
+	v.checkConfig(config)
+	if len(v.problems) > 0 {
+		return nil, &ConfigError{FileName: fileName, Problems: v.problems}
+	}
+	return config, nil
+}
+
+// validateProxies decode the proxies posted to the admin API strictly and
+// check them like the proxies in configuration file
+func validateProxies(name string, content []byte) (*ProxyConfs, error) {
+	proxyConfs := &ProxyConfs{}
+	v, err := newConfigValidator(name, content, proxyConfs)
+	if err != nil {
+		return nil, err
+	}
+	v.checkProxies(proxyConfs.Proxies)
+	if len(v.problems) > 0 {
+		return nil, &ConfigError{FileName: name, Problems: v.problems}
+	}
+	return proxyConfs, nil
+}
+
+// validateState decode the state file strictly and check the proxies in it
+// like the proxies in configuration file
+func validateState(fileName string, content []byte) (*ConfigState, error) {
+	state := &ConfigState{}
+	v, err := newConfigValidator(fileName, content, state)
+	if err != nil {
+		return nil, err
+	}
+	v.checkProxies(state.Proxies)
+	if len(v.problems) > 0 {
+		return nil, &ConfigError{FileName: fileName, Problems: v.problems}
+	}
+	return state, nil
+}
+
+// newConfigValidator decode the content to out strictly and create a
+// configValidator with its yaml node tree
+func newConfigValidator(fileName string, content []byte, out interface{}) (*configValidator, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err := decoder.Decode(out)
+	if err != nil {
+		return nil, &ConfigError{FileName: fileName, Problems: getYamlErrors(err)}
+	}
+	root := &yaml.Node{}
+	if err = yaml.Unmarshal(content, root); err != nil {
+		return nil, &ConfigError{FileName: fileName, Problems: getYamlErrors(err)}
+	}
+	return &configValidator{root: root, problems: make([]string, 0)}, nil
+}
+
+// getYamlErrors get the problems in the error of yaml decoder
+func getYamlErrors(err error) []string {
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		return typeError.Errors
+	}
+	return []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+}
+
+// subPath create the path of child node
+func subPath(path []interface{}, elems ...interface{}) []interface{} {
+	r := make([]interface{}, 0, len(path)+len(elems))
+	r = append(r, path...)
+	return append(r, elems...)
+}
+
+// getLine get the line of the node by the path of mapping keys and sequence
+// indexes, the line of nearest parent is returned if the node is not found
+func (v *configValidator) getLine(path []interface{}) int {
+	node := v.root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		var child *yaml.Node
+		switch e := elem.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == e {
+						child = node.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+				child = node.Content[e]
+			}
+		}
+		if child == nil {
+			break
+		}
+		node = child
+	}
+	return node.Line
+}
+
+func (v *configValidator) addProblem(path []interface{}, format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf("line %d: %s", v.getLine(path), fmt.Sprintf(format, args...)))
+}
+
+func (v *configValidator) checkConfig(config *ProxiesConfigure) {
+	v.checkDuration([]interface{}{"shutdownTimeout"}, config.ShutdownTimeout)
+	v.checkProxies(config.Proxies)
+}
+
+func (v *configValidator) checkProxies(proxies []ProxyConf) {
+	names := make(map[string]bool)
+	// the hosts listened on each port
+	listens := make(map[string][]string)
+	for i := range proxies {
+		proxyConf := &proxies[i]
+		path := []interface{}{"proxies", i}
+		if len(proxyConf.Name) <= 0 {
+			v.addProblem(path, "the proxy name is required")
+		} else if names[proxyConf.Name] {
+			v.addProblem(subPath(path, "name"), "duplicate proxy %s", proxyConf.Name)
+		}
+		names[proxyConf.Name] = true
+		if err := checkAddr(proxyConf.Listen, true); err != nil {
+			v.addProblem(subPath(path, "listen"), "invalid listen address %q: %v", proxyConf.Listen, err)
+		} else if host, port, _ := splitAddr(proxyConf.Listen); port != "0" {
+			host = normalizeListenHost(host)
+			if isListenConflict(listens[port], host) {
+				v.addProblem(subPath(path, "listen"), "duplicate listen address %s", proxyConf.Listen)
+			}
+			listens[port] = append(listens[port], host)
+		}
+		v.checkDuration(subPath(path, "requestTimeout"), proxyConf.RequestTimeout)
+		if proxyConf.MaxMessageSize < 0 {
+			v.addProblem(subPath(path, "maxMessageSize"), "invalid max message size %d", proxyConf.MaxMessageSize)
+		}
+		v.checkOutlierDetection(subPath(path, "outlierDetection"), proxyConf.OutlierDetection)
+		v.checkBackends(subPath(path, "backends"), proxyConf.Backends)
+		for j := range proxyConf.Routes {
+			routePath := subPath(path, "routes", j)
+			v.checkOutlierDetection(subPath(routePath, "outlierDetection"), proxyConf.Routes[j].OutlierDetection)
+			v.checkBackends(subPath(routePath, "backends"), proxyConf.Routes[j].Backends)
+		}
+	}
+}
+
+func (v *configValidator) checkBackends(path []interface{}, backends []BackendInfo) {
+	for i := range backends {
+		backend := &backends[i]
+		backendPath := subPath(path, i)
+		if err := checkAddr(backend.Addr, false); err != nil {
+			v.addProblem(subPath(backendPath, "addr"), "invalid backend address %q: %v", backend.Addr, err)
+		}
+		v.checkDuration(subPath(backendPath, "drainTimeout"), backend.DrainTimeout)
+		if backend.Readiness != nil {
+			readinessPath := subPath(backendPath, "readiness")
+			if !inStrArray(backend.Readiness.Protocol, readinessProtocols) {
+				v.addProblem(subPath(readinessPath, "protocol"), "unknown readiness protocol %q, it should be one of %s", backend.Readiness.Protocol, strings.Join(readinessProtocols, ", "))
+			}
+			v.checkDuration(subPath(readinessPath, "interval"), backend.Readiness.Interval)
+			v.checkDuration(subPath(readinessPath, "timeout"), backend.Readiness.Timeout)
+		}
+		if backend.CircuitBreaker != nil {
+			v.checkDuration(subPath(backendPath, "circuitBreaker", "pauseTime"), backend.CircuitBreaker.PauseTime)
+		}
+		if backend.Reconnect != nil {
+			reconnectPath := subPath(backendPath, "reconnect")
+			v.checkDuration(subPath(reconnectPath, "initialDelay"), backend.Reconnect.InitialDelay)
+			v.checkDuration(subPath(reconnectPath, "maxDelay"), backend.Reconnect.MaxDelay)
+			v.checkDuration(subPath(reconnectPath, "dialTimeout"), backend.Reconnect.DialTimeout)
+			if jitter := backend.Reconnect.Jitter; jitter != nil && (*jitter < 0 || *jitter > 1) {
+				v.addProblem(subPath(reconnectPath, "jitter"), "invalid jitter %v, it should be in range [0, 1]", *jitter)
+			}
+		}
+		if backend.HealthCheck != nil {
+			v.checkDuration(subPath(backendPath, "healthCheck", "interval"), backend.HealthCheck.Interval)
+			v.checkDuration(subPath(backendPath, "healthCheck", "timeout"), backend.HealthCheck.Timeout)
+		}
+		if backend.SlowStart != nil {
+			v.checkDuration(subPath(backendPath, "slowStart", "window"), backend.SlowStart.Window)
+		}
+	}
+}
+
+func (v *configValidator) checkOutlierDetection(path []interface{}, conf *OutlierDetectionConf) {
+	if conf == nil {
+		return
+	}
+	v.checkDuration(subPath(path, "interval"), conf.Interval)
+	v.checkDuration(subPath(path, "baseEjectionTime"), conf.BaseEjectionTime)
+	v.checkDuration(subPath(path, "maxEjectionTime"), conf.MaxEjectionTime)
+}
+
+// checkDuration check the duration if it is set
+func (v *configValidator) checkDuration(path []interface{}, duration string) {
+	if len(duration) <= 0 {
+		return
+	}
+	if _, err := parseDuration(duration); err != nil {
+		v.addProblem(path, "invalid duration %q of %s, it should be like 100ms or 10s", duration, path[len(path)-1])
+	}
+}
+
+// normalizeListenHost convert the host of listen address to a comparable
+// form, the empty string is returned if it listens on all the addresses
+func normalizeListenHost(host string) string {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return ""
+		}
+		return ip.String()
+	}
+	return host
+}
+
+// isListenConflict check if the host conflicts with the hosts listened on
+// the same port, the host listening on all the addresses conflicts with any host
+func isListenConflict(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host || len(h) <= 0 || len(host) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr check if the address is in host:port format, the host can be
+// empty and the port can be 0 if it is a listen address
+func checkAddr(addr string, listen bool) error {
+	hostname, port, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+	if len(hostname) <= 0 && !listen {
+		return missingHostError
+	}
+	minPort := 1
+	if listen {
+		minPort = 0
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < minPort || n > 65535 {
+		return invalidPortError
+	}
+	return nil
+}
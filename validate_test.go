@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	content := `
+proxies:
+  - name: test-1
+    listen: ":9090"
+    requestTimout: 10s
+`
+	_, err := validateConfig("test.yaml", []byte(content))
+	if err == nil || !strings.Contains(err.Error(), "line 5: field requestTimout not found") {
+		t.Errorf("The unknown key should be rejected: %v", err)
+	}
+
+	content = `
+shutdownTimeout: 1m
+proxies:
+  - name: test-1
+    listen: ":9090"
+    backends:
+      - addr: "127.0.0.1"
+        readiness:
+          protocol: udp
+        reconnect:
+          jitter: -0.1
+  - name: test-1
+    listen: ":9090"
+`
+	_, err = validateConfig("test.yaml", []byte(content))
+	configError, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("The error %v is not expected", err)
+	}
+	expected := []string{"line 2: invalid duration",
+		"line 7: invalid backend address",
+		"line 9: unknown readiness protocol",
+		"line 11: invalid jitter",
+		"line 12: duplicate proxy",
+		"line 13: duplicate listen address"}
+	if len(configError.Problems) != len(expected) {
+		t.Fatalf("The problems %v are not expected", configError.Problems)
+	}
+	for i, problem := range configError.Problems {
+		if !strings.HasPrefix(problem, expected[i]) {
+			t.Errorf("The problem %s is not expected", problem)
+		}
+	}
+
+	content = `
+proxies:
+  - name: test-1
+    listen: "127.0.0.1:0"
+    requestTimeout: 500ms
+    backends:
+      - addr: "localhost:9091"
+  - name: test-2
+    listen: "127.0.0.1:0"
+`
+	if _, err = validateConfig("test.yaml", []byte(content)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateListenConflict(t *testing.T) {
+	content := `
+proxies:
+  - name: test-1
+    listen: ":9090"
+  - name: test-2
+    listen: "0.0.0.0:9090"
+  - name: test-3
+    listen: "127.0.0.1:9090"
+  - name: test-4
+    listen: "127.0.0.1:9091"
+  - name: test-5
+    listen: "[::1]:9091"
+  - name: test-6
+    listen: "[::]:9091"
+`
+	_, err := validateConfig("test.yaml", []byte(content))
+	configError, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("The error %v is not expected", err)
+	}
+	expected := []string{"line 6: duplicate listen address",
+		"line 8: duplicate listen address",
+		"line 14: duplicate listen address"}
+	if len(configError.Problems) != len(expected) {
+		t.Fatalf("The problems %v are not expected", configError.Problems)
+	}
+	for i, problem := range configError.Problems {
+		if !strings.HasPrefix(problem, expected[i]) {
+			t.Errorf("The problem %s is not expected", problem)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// WeightedRoundrobin implements the smooth weighted round-robin
+// LoadBalancer, the backends are selected in proportion to their
+// weights and the selections of a backend are spread out
+type WeightedRoundrobin struct {
+	*backendPool
+	lock           sync.Mutex
+	currentWeights map[Backend]int
+}
+
+// NewWeightedRoundrobin create a WeightedRoundrobin object
+func NewWeightedRoundrobin() *WeightedRoundrobin {
+	w := &WeightedRoundrobin{backendPool: newBackendPool(),
+		currentWeights: make(map[Backend]int)}
+	w.selector = w.selectBackend
+	return w
+}
+
+// Send send a request to one of thrift backend server
+func (w *WeightedRoundrobin) Send(request *Message, requestTimeoutTime time.Time, callback ResponseCallback) {
+	w.sendWithFailover(request, requestTimeoutTime, w.selectBackend, make(map[Backend]bool), callback)
+}
+
+func (w *WeightedRoundrobin) selectBackend(request *Message, excluded map[Backend]bool) (Backend, error) {
+	backends := w.getSelectableBackends()
+	if len(backends) <= 0 {
+		return nil, noBackendAvailable
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// forget the removed backends
+	if len(w.currentWeights) > len(backends) {
+		currentWeights := make(map[Backend]int)
+		for _, backend := range backends {
+			currentWeights[backend] = w.currentWeights[backend]
+		}
+		w.currentWeights = currentWeights
+	}
+
+	total := 0
+	var best Backend = nil
+	for _, backend := range backends {
+		if excluded[backend] {
+			continue
+		}
+		weight := effectiveWeight(backend)
+		w.currentWeights[backend] += weight
+		total += weight
+		if best == nil || w.currentWeights[backend] > w.currentWeights[best] {
+			best = backend
+		}
+	}
+	if best == nil {
+		return nil, failedAllBackends
+	}
+	w.currentWeights[best] -= total
+	return best, nil
+}
+
+// effectiveWeight the weight scaled by the slow start factor, the weight is
+// multiplied by 100 to keep the precision of the factor
+func effectiveWeight(backend Backend) int {
+	weight := int(float64(backend.GetWeight()*100) * backend.GetSlowStartFactor())
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}